@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// archived reports whether key is under the ArchivePrefix of p. Archived
+// backups are out of the way of listings and retention, but can still be
+// restored by key for a grace period.
+func (p retentionPolicy) archived(key string) bool {
+	return p.ArchivePrefix != "" && strings.HasPrefix(key, p.ArchivePrefix)
+}
+
+// archiveBackup moves the objects of backup under the ArchivePrefix of the
+// retention policy of dest, with their metadata where the backend returns it.
+func archiveBackup(ctx context.Context, dest Destination, backup storedBackup) error {
+	for _, obj := range backup.Objects {
+		var metadata map[string]string
+		if reader, ok := dest.Storage.(MetadataReader); ok {
+			var err error
+			if metadata, err = reader.Metadata(ctx, obj.Key); err != nil {
+				return err
+			}
+		}
+
+		body, err := dest.Storage.Get(ctx, obj.Key)
+		if err != nil {
+			return err
+		}
+		err = dest.Storage.Put(ctx, dest.Retention.ArchivePrefix+obj.Key, body, obj.Size, metadata)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The originals are only deleted once every object was archived.
+	for _, obj := range backup.Objects {
+		if err := dest.Storage.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneArchive deletes the archived backups of dbName on dest that were
+// archived more than the ArchiveDays of its retention policy ago.
+func pruneArchive(ctx context.Context, dest Destination, dbName string) error {
+	objects, err := dest.Storage.List(ctx, dest.Retention.ArchivePrefix+listPrefix(dest.KeyPrefix, dbName))
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -dest.Retention.ArchiveDays)
+	for _, obj := range objects {
+		if !dest.Retention.archived(obj.Key) || !obj.LastModified.Before(cutoff) {
+			continue
+		}
+		reason := fmt.Sprintf("archived more than RETENTION_ARCHIVE_DAYS of %d days ago", dest.Retention.ArchiveDays)
+		if dest.Retention.DryRun {
+			slog.Info("Retention dry run: would delete archived backup", "job", "prune", "source", dbName, "destination", dest.Name, "key", obj.Key, "bytes", obj.Size, "reason", reason)
+			continue
+		}
+		if err := dest.Storage.Delete(ctx, obj.Key); err != nil {
+			slog.Error("Failed to delete archived backup", "job", "prune", "source", dbName, "destination", dest.Name, "key", obj.Key, "error", err)
+			continue
+		}
+		slog.Info("Deleted archived backup", "job", "prune", "source", dbName, "destination", dest.Name, "key", obj.Key, "reason", reason)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is a single pattern of a .backupignore file.
+type ignoreRule struct {
+	// base is the directory of the ignore file, relative to the root of the
+	// backup. The rule only applies to paths below it.
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// ignoreRules are the rules of all ignore files seen so far, in the order
+// they were read. Like with .gitignore, the last matching rule decides.
+type ignoreRules []ignoreRule
+
+// loadIgnoreFile reads the ignore file in the directory dir, whose path
+// relative to the root of the backup is base, and appends its rules. A
+// missing file is not an error.
+//
+// The syntax is a subset of .gitignore: one glob pattern per line, blank
+// lines and lines starting with # are ignored, ! negates a pattern, a
+// trailing / only matches directories, and a pattern with a slash other than
+// a trailing one is anchored to the directory of the ignore file. Other
+// patterns match a file or directory of that name at any depth.
+func (r ignoreRules) loadIgnoreFile(dir, base, name string) (ignoreRules, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+
+		r = append(r, rule)
+	}
+
+	return r, scanner.Err()
+}
+
+// excluded reports whether the slash separated path rel, relative to the
+// root of the backup, is excluded by the rules.
+func (r ignoreRules) excluded(rel string, isDir bool) bool {
+	excluded := false
+	for _, rule := range r {
+		if rule.matches(rel, isDir) {
+			excluded = !rule.negate
+		}
+	}
+
+	return excluded
+}
+
+func (rule ignoreRule) matches(rel string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+
+	if rule.base != "" {
+		if !strings.HasPrefix(rel, rule.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, rule.base+"/")
+	}
+
+	if !rule.anchored {
+		rel = path.Base(rel)
+	}
+
+	ok, _ := path.Match(rule.pattern, rel)
+	return ok
+}
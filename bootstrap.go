@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// bootstrapRestore restores the latest backup of the SQLite database at
+// DB_PATH if it doesn't exist, so a new host starts out with the data of the
+// last backup before backing it up again. Without any backups yet, as on the
+// very first start, the database is left to the application to create.
+func bootstrapRestore(cfg *Config) error {
+	if _, err := os.Stat(cfg.DBPath); !os.IsNotExist(err) {
+		return err
+	}
+
+	restoreCfg, err := restoreConfig(cfg)
+	if err != nil {
+		return err
+	}
+	sources, err := newSources(restoreCfg)
+	if err != nil {
+		return err
+	}
+	var name string
+	for _, source := range sources {
+		if s, ok := source.(*sqliteSource); ok && s.cmd == nil && s.dbPath == cfg.DBPath {
+			name = s.Name()
+		}
+	}
+	if name == "" {
+		return nil
+	}
+
+	ctx := context.Background()
+	destinations, err := newDestinations(restoreCfg)
+	if err != nil {
+		return err
+	}
+	latest, err := latestBackupKey(ctx, destinations[0], name)
+	if err != nil {
+		return err
+	}
+	if latest == "" {
+		slog.Info("Database doesn't exist and there are no backups of it yet, starting without it", "job", "restore", "source", name, "destination", destinations[0].Name, "path", cfg.DBPath)
+		return nil
+	}
+
+	slog.Info("Database doesn't exist, restoring the latest backup", "job", "restore", "source", name, "destination", destinations[0].Name, "key", latest, "path", cfg.DBPath)
+	dest, key := restoreSource(ctx, restoreCfg, destinations[0], latest)
+	return restoreBackup(ctx, restoreCfg, dest, key, cfg.DBPath, false)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// bundleSource wraps a source to add files describing the deployment, such as
+// docker-compose.yml or an nginx config, to its backups, so that a restore
+// brings back more than just the data. The backup becomes a tar archive with
+// the dump of the wrapped source and the files below files/, named by their
+// absolute path.
+type bundleSource struct {
+	Source
+	files      []string
+	redactKeys []string
+	tempDir    string
+}
+
+// bundleSources wraps every source in a bundleSource if BUNDLE_FILES is set.
+func bundleSources(cfg *Config, list []Source) []Source {
+	files := splitList(cfg.BundleFiles)
+	if len(files) == 0 {
+		return list
+	}
+
+	bundled := make([]Source, len(list))
+	for i, source := range list {
+		bundled[i] = &bundleSource{
+			Source:     source,
+			files:      files,
+			redactKeys: splitList(cfg.BundleRedactKeys),
+			tempDir:    cfg.BackupDir,
+		}
+	}
+
+	return bundled
+}
+
+func (s *bundleSource) Extension() string { return s.Source.Extension() + ".tar" }
+
+// Metadata passes the metadata of the wrapped source on.
+func (s *bundleSource) Metadata() map[string]string {
+	if provider, ok := s.Source.(MetadataProvider); ok {
+		return provider.Metadata()
+	}
+
+	return nil
+}
+
+func (s *bundleSource) Dump(ctx context.Context, w io.Writer) error {
+	// The size of a tar entry must be known up front, so the dump is spooled
+	// to a temporary file first.
+	tmp, err := os.CreateTemp(s.tempDir, s.Name()+"-*"+s.Source.Extension())
+	if err != nil {
+		return fmt.Errorf("failed to create dump file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := s.Source.Dump(ctx, tmp); err != nil {
+		return err
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat dump file: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read dump file: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	hdr := &tar.Header{Name: s.Name() + s.Source.Extension(), Mode: 0644, Size: info.Size(), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if _, err := io.Copy(tw, tmp); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+
+	for _, pattern := range s.files {
+		if err := s.addFiles(tw, pattern); err != nil {
+			return fmt.Errorf("failed to bundle %s: %w", pattern, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+
+	return nil
+}
+
+// addFiles adds the files and directories matching pattern. Files that don't
+// exist are skipped with a warning rather than failing the backup of the data.
+func (s *bundleSource) addFiles(tw *tar.Writer, pattern string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		slog.Warn("Not bundling missing file", "job", "backup", "source", s.Name(), "path", pattern)
+		return nil
+	}
+
+	for _, match := range matches {
+		abs, err := filepath.Abs(match)
+		if err != nil {
+			return err
+		}
+
+		err = filepath.WalkDir(abs, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel := path.Join("files", filepath.ToSlash(p))
+			if !d.IsDir() && isEnvFile(d.Name()) {
+				return s.addRedacted(tw, p, rel, d)
+			}
+			return addToTar(tw, p, rel, d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addRedacted adds the env file at p with the values of secret variables
+// replaced.
+func (s *bundleSource) addRedacted(tw *tar.Writer, p, rel string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		buf.WriteString(redactEnvLine(scanner.Text(), s.redactKeys))
+		buf.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	hdr.Size = int64(buf.Len())
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = tw.Write(buf.Bytes())
+	return err
+}
+
+// isEnvFile reports whether a file is an env file, like .env or prod.env.
+func isEnvFile(name string) bool {
+	return name == ".env" || strings.HasPrefix(name, ".env.") || strings.HasSuffix(name, ".env")
+}
+
+// redactEnvLine replaces the value of a KEY=value line if the key matches one
+// of the patterns, case-insensitively. Other lines are returned unchanged.
+func redactEnvLine(line string, patterns []string) string {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return line
+	}
+
+	key, _, ok := strings.Cut(trimmed, "=")
+	if !ok {
+		return line
+	}
+	key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(key)); ok {
+			return line[:strings.Index(line, "=")+1] + "REDACTED"
+		}
+	}
+
+	return line
+}
+
+// bundleNameRe matches the name of a bundle once decrypted and decompressed,
+// capturing the source name and the extension of the dump in it. Sources
+// that are tar archives themselves are only bundles with a second .tar.
+var bundleNameRe = regexp.MustCompile(`^(.+)_backup_(?:[^_]+_)?\d{8}_\d{6}(\..+)\.tar$`)
+
+// bundledDump returns the name of the dump in the bundle named name, like
+// app.sql for app_backup_20240101_020000.sql.tar, or an empty string if name
+// isn't a bundle.
+func bundledDump(name string) string {
+	m := bundleNameRe.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+
+	return m[1] + m[2]
+}
+
+// openBundledDump returns the dump named entry from the bundle read from r,
+// which is always its first file. The bundled files are left in r.
+func openBundledDump(r io.Reader, entry string) (io.Reader, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	if hdr.Name != entry {
+		return nil, fmt.Errorf("bundle doesn't start with %s", entry)
+	}
+
+	return tr, nil
+}
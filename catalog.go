@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// backupCatalog lists the backups of a source on a destination. It is kept
+// next to the backups as <name>_catalog.json, so they can be listed without
+// parsing object names or reading the metadata of every backup.
+type backupCatalog struct {
+	Backups []catalogEntry `json:"backups"`
+}
+
+// catalogEntry describes a backup in the catalog of its source.
+type catalogEntry struct {
+	Key             string    `json:"key"`
+	Source          string    `json:"source"`
+	Timestamp       time.Time `json:"timestamp"`
+	Size            int64     `json:"size"`
+	SHA256          string    `json:"sha256,omitempty"`
+	Encryption      string    `json:"encryption,omitempty"`
+	EncryptionKeyID string    `json:"encryption_key_id,omitempty"`
+	Tier            string    `json:"tier,omitempty"`
+	Parts           int       `json:"parts,omitempty"`
+	// Protected backups are never deleted by the retention sweep.
+	Protected bool `json:"protected,omitempty"`
+}
+
+func catalogKey(dest Destination, dbName string) string {
+	return listPrefix(dest.KeyPrefix, dbName) + dbName + "_catalog.json"
+}
+
+// latestKey returns the key of the pointer to the latest backup of dbName on
+// dest, <name>_latest.json next to the backups, which holds its catalog
+// entry.
+func latestKey(dest Destination, dbName string) string {
+	return listPrefix(dest.KeyPrefix, dbName) + dbName + "_latest.json"
+}
+
+// updateLatest points the latest pointer of the source of entry on dest to
+// entry.
+func updateLatest(ctx context.Context, dest Destination, entry catalogEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	return dest.Storage.Put(ctx, latestKey(dest, entry.Source), bytes.NewReader(data), int64(len(data)), nil)
+}
+
+// latestBackupKey returns the key of the latest backup of dbName on dest,
+// read from its latest pointer without listing dest where there is one, or
+// an empty string if there are no backups.
+func latestBackupKey(ctx context.Context, dest Destination, dbName string) (string, error) {
+	if r, err := dest.Storage.Get(ctx, latestKey(dest, dbName)); err == nil {
+		defer r.Close()
+
+		var entry catalogEntry
+		if err := json.NewDecoder(r).Decode(&entry); err == nil && entry.Key != "" {
+			return entry.Key, nil
+		}
+	}
+
+	backups, err := listBackups(ctx, dest, dbName)
+	if err != nil || len(backups) == 0 {
+		return "", err
+	}
+
+	return backups[0].Key, nil
+}
+
+// errNoCatalog is returned by readCatalog for a source without a catalog.
+var errNoCatalog = errors.New("no catalog")
+
+// readCatalog downloads the catalog of dbName on dest. It returns
+// errNoCatalog only if there is none, and any other error if it couldn't be
+// read, in which case it must not be replaced, or protected backups would
+// lose their protection.
+func readCatalog(ctx context.Context, dest Destination, dbName string) (*backupCatalog, error) {
+	key := catalogKey(dest, dbName)
+	r, err := dest.Storage.Get(ctx, key)
+	if err != nil {
+		// Backends report missing objects differently, so a failed download
+		// only means there is no catalog if it isn't listed either.
+		objects, lerr := dest.Storage.List(ctx, key)
+		if lerr != nil {
+			return nil, fmt.Errorf("failed to read catalog: %w", err)
+		}
+		for _, obj := range objects {
+			if obj.Key == key {
+				return nil, fmt.Errorf("failed to read catalog: %w", err)
+			}
+		}
+		return nil, errNoCatalog
+	}
+	defer r.Close()
+
+	var catalog backupCatalog
+	if err := json.NewDecoder(r).Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("invalid catalog: %w", err)
+	}
+
+	return &catalog, nil
+}
+
+// updateCatalog adds entry to the catalog of its source on dest, and drops
+// the deleted backups from it. A destination without a catalog yet gets one
+// listing the backups already on it.
+func updateCatalog(ctx context.Context, dest Destination, entry catalogEntry, deleted []string) error {
+	catalog, err := readCatalog(ctx, dest, entry.Source)
+	if errors.Is(err, errNoCatalog) {
+		catalog, err = listedCatalog(ctx, dest, entry.Source)
+	}
+	if err != nil {
+		return err
+	}
+
+	drop := map[string]bool{entry.Key: true}
+	for _, key := range deleted {
+		drop[key] = true
+	}
+	backups := []catalogEntry{}
+	for _, backup := range catalog.Backups {
+		if !drop[backup.Key] {
+			backups = append(backups, backup)
+		}
+	}
+	catalog.Backups = append(backups, entry)
+
+	return writeCatalog(ctx, dest, entry.Source, catalog)
+}
+
+// removeFromCatalog drops the deleted backups from the catalog of dbName on
+// dest, if it has one.
+func removeFromCatalog(ctx context.Context, dest Destination, dbName string, deleted []string) error {
+	if len(deleted) == 0 {
+		return nil
+	}
+	catalog, err := readCatalog(ctx, dest, dbName)
+	if errors.Is(err, errNoCatalog) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	drop := map[string]bool{}
+	for _, key := range deleted {
+		drop[key] = true
+	}
+	backups := []catalogEntry{}
+	for _, backup := range catalog.Backups {
+		if !drop[backup.Key] {
+			backups = append(backups, backup)
+		}
+	}
+	catalog.Backups = backups
+
+	return writeCatalog(ctx, dest, dbName, catalog)
+}
+
+// writeCatalog uploads catalog as the catalog of dbName on dest.
+func writeCatalog(ctx context.Context, dest Destination, dbName string, catalog *backupCatalog) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	return dest.Storage.Put(ctx, catalogKey(dest, dbName), bytes.NewReader(data), int64(len(data)), nil)
+}
+
+// protectedBackups returns the keys of the protected backups of dbName on
+// dest, none if it has no catalog.
+func protectedBackups(ctx context.Context, dest Destination, dbName string) (map[string]bool, error) {
+	protected := map[string]bool{}
+	catalog, err := readCatalog(ctx, dest, dbName)
+	if errors.Is(err, errNoCatalog) {
+		return protected, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range catalog.Backups {
+		if entry.Protected {
+			protected[entry.Key] = true
+		}
+	}
+
+	return protected, nil
+}
+
+// listedCatalog builds the catalog of dbName on dest from a listing of its
+// backups.
+func listedCatalog(ctx context.Context, dest Destination, dbName string) (*backupCatalog, error) {
+	backups, err := listStoredBackups(ctx, dest, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := &backupCatalog{}
+	for _, backup := range backups {
+		catalog.Backups = append(catalog.Backups, catalogEntry{
+			Key:       backup.Key,
+			Source:    dbName,
+			Timestamp: backup.LastModified,
+			Size:      backup.Size,
+			SHA256:    backup.SHA256,
+			Parts:     backup.Parts,
+		})
+	}
+
+	return catalog, nil
+}
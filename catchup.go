@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runAndRecord runs a backup of tier and records when it started if every
+// source was backed up, for the readiness check and, with CATCH_UP, on disk,
+// so a window missed while the service was down can be caught up on after a
+// restart. Nothing runs while backups
+// are paused.
+func runAndRecord(cfg *Config, destinations []Destination, tier string) {
+	if paused(cfg) {
+		slog.Info("Backup skipped: backups are paused, remove the pause file to resume", "job", "backup", "path", pauseFilePath(cfg))
+		return
+	}
+
+	start := time.Now()
+	if !runBackup(cfg, destinations, tier) {
+		return
+	}
+	health.recordSuccess(cfg, tier, start)
+	if !cfg.CatchUp {
+		return
+	}
+
+	if err := writeLastRun(cfg, tier, start); err != nil {
+		slog.Warn("Failed to record backup run", "error", err)
+	}
+}
+
+// catchUp runs a backup of every tier whose schedule had a run due since its
+// last successful run. Tiers that never ran are left to their schedule, as
+// there is nothing to tell a missed run from a fresh installation.
+func catchUp(cfg *Config, destinations []Destination) {
+	for _, schedule := range cfg.Schedules {
+		last, ok := readLastRun(cfg, schedule.Tier)
+		if !ok {
+			continue
+		}
+
+		sched, err := cronParser.Parse(schedule.Spec)
+		if err != nil {
+			continue
+		}
+		due := sched.Next(last.In(cfg.Location))
+		if due.After(time.Now()) {
+			continue
+		}
+
+		slog.Info("Missed backup, catching up now", "job", "backup", "schedule", schedule.Spec, "tier", schedule.Tier, "due", due)
+		runAndRecord(cfg, destinations, schedule.Tier)
+	}
+}
+
+// paused reports whether scheduled backups are paused, which they are while
+// the pause file exists, e.g. during a maintenance window:
+//
+//	docker exec backup touch /backups/paused
+func paused(cfg *Config) bool {
+	_, err := os.Stat(pauseFilePath(cfg))
+	return err == nil
+}
+
+func pauseFilePath(cfg *Config) string {
+	if cfg.PauseFile != "" {
+		return cfg.PauseFile
+	}
+
+	return filepath.Join(stateDir(cfg), "paused")
+}
+
+func stateDir(cfg *Config) string {
+	if cfg.StateDir != "" {
+		return cfg.StateDir
+	}
+
+	return cfg.BackupDir
+}
+
+// lastRunPath returns the file the start of the last successful run of tier
+// is kept in, one per source block and tier.
+func lastRunPath(cfg *Config, tier string) string {
+	name := "last-run"
+	if cfg.Block != "" {
+		name += "-" + strings.ToLower(envName(cfg.Block))
+	}
+	if tier != "" {
+		name += "-" + tier
+	}
+
+	return filepath.Join(stateDir(cfg), name)
+}
+
+func readLastRun(cfg *Config, tier string) (time.Time, bool) {
+	data, err := os.ReadFile(lastRunPath(cfg, tier))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Failed to read last backup run", "error", err)
+		}
+		return time.Time{}, false
+	}
+
+	last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		slog.Warn("Failed to read last backup run", "error", err)
+		return time.Time{}, false
+	}
+
+	return last, true
+}
+
+func writeLastRun(cfg *Config, tier string, at time.Time) error {
+	path := lastRunPath(cfg, tier)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Written to a temporary file first, so a crash can't leave a truncated
+	// timestamp behind.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(at.UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+
+	return os.Rename(tmp, path)
+}
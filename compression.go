@@ -0,0 +1,131 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/pgzip"
+)
+
+func init() {
+	registerCompressor("gzip", newGzipCompressor)
+	registerCompressor("none", newNoCompressor)
+}
+
+// Compressor compresses backups before they are uploaded. Implementations
+// register themselves by name with registerCompressor and are selected with
+// the COMPRESSION environment variable.
+type Compressor interface {
+	// Extension is appended to the file name of compressed backups.
+	Extension() string
+	// NewWriter returns a writer compressing into w. Closing it flushes the
+	// compressed data, but doesn't close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing r, for restores.
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+type compressorFactory func(cfg *Config) (Compressor, error)
+
+var compressors = map[string]compressorFactory{}
+
+func registerCompressor(name string, factory compressorFactory) {
+	compressors[name] = factory
+}
+
+func newCompressor(cfg *Config) (Compressor, error) {
+	factory, ok := compressors[cfg.Compression]
+	if !ok {
+		names := make([]string, 0, len(compressors))
+		for name := range compressors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown compression %q (available: %s)", cfg.Compression, strings.Join(names, ", "))
+	}
+
+	return factory(cfg)
+}
+
+// pgzipBlockSize is the size of the blocks pgzip compresses in parallel.
+const pgzipBlockSize = 1 << 20
+
+type gzipCompressor struct {
+	// level is the gzip compression level, 0 for the default.
+	level int
+	// threads is how many blocks are compressed in parallel. With more than
+	// one, multi-gigabyte backups are compressed with pgzip on all cores
+	// instead of saturating a single one; the output is regular gzip either
+	// way.
+	threads int
+}
+
+func newGzipCompressor(cfg *Config) (Compressor, error) {
+	if cfg.CompressionLevel < 0 || cfg.CompressionLevel > 9 {
+		return nil, fmt.Errorf("invalid COMPRESSION_LEVEL %d (expected 1 to 9)", cfg.CompressionLevel)
+	}
+
+	threads := cfg.CompressionThreads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	return gzipCompressor{level: cfg.CompressionLevel, threads: threads}, nil
+}
+
+func (gzipCompressor) Extension() string { return ".gz" }
+
+func (c gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	if c.threads <= 1 {
+		return gzip.NewWriterLevel(w, level)
+	}
+
+	pw, err := pgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	if err := pw.SetConcurrency(pgzipBlockSize, c.threads); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// NewReader also reads backups compressed with pgzip, which are regular gzip.
+func (gzipCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// noCompressor stores backups as they are, for data that is compressed
+// already, like media files or archives, where another pass only costs CPU
+// time and makes the backup slightly larger.
+type noCompressor struct{}
+
+func newNoCompressor(cfg *Config) (Compressor, error) {
+	return noCompressor{}, nil
+}
+
+func (noCompressor) Extension() string { return "" }
+
+func (noCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	return r, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+func init() {
+	registerCompressor("lz4", newLZ4Compressor)
+}
+
+// lz4Compressor compresses with LZ4, which is several times faster than gzip
+// at a worse ratio, for large databases on hosts with weak CPUs.
+type lz4Compressor struct{}
+
+func newLZ4Compressor(cfg *Config) (Compressor, error) {
+	return lz4Compressor{}, nil
+}
+
+func (lz4Compressor) Extension() string { return ".lz4" }
+
+func (lz4Compressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return lz4.NewWriter(w), nil
+}
+
+func (lz4Compressor) NewReader(r io.Reader) (io.Reader, error) {
+	return lz4.NewReader(r), nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+func init() {
+	registerCompressor("xz", newXZCompressor)
+}
+
+// xzCompressor compresses with xz (LZMA2), which is much slower than gzip but
+// gives noticeably smaller backups, for long-term archives where storage
+// costs more than CPU time.
+type xzCompressor struct{}
+
+func newXZCompressor(cfg *Config) (Compressor, error) {
+	return xzCompressor{}, nil
+}
+
+func (xzCompressor) Extension() string { return ".xz" }
+
+func (xzCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return xz.NewWriter(w)
+}
+
+func (xzCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	return xz.NewReader(r)
+}
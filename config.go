@@ -0,0 +1,961 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+type Config struct {
+	SourceTypes        []string
+	SourceName         string
+	Schedules          []backupSchedule
+	Location           *time.Location
+	SkipInitialBackup  bool
+	CatchUp            bool
+	BootstrapRestore   bool
+	StateDir           string
+	PauseFile          string
+	VerifySchedule     string
+	RestorePreCommand  string
+	RestorePostCommand string
+	HTTPAddr           string
+	HTTPToken          string
+	HealthAddr         string
+	HealthGrace        time.Duration
+	Block              string
+	Compression        string
+	CompressionLevel   int
+	CompressionThreads int
+	DBPath             string
+	HostDBPath         string
+	BackupDir          string
+	BackupMode         string
+	WALCheckpoint      bool
+	IntegrityCheck     string
+	RetentionDays      int
+	// TierRetentionDays overrides RetentionDays for the backups of a tier.
+	TierRetentionDays  map[string]int
+	RetentionCount     int
+	RetentionDaily     int
+	RetentionWeekly    int
+	RetentionMonthly   int
+	RetentionYearly    int
+	RetentionMaxSize   int64
+	RetentionMinCount  int
+	ArchiveDays        int
+	ArchivePrefix      string
+	RetentionDryRun    bool
+	BucketLifecycle    bool
+	KeepLocalBackups   int
+	LocalRetentionDays int
+
+	// Client-side encryption
+	Encryption             string
+	EncryptionKey          string
+	EncryptionPreviousKeys string
+	AgeRecipients          string
+	AgeRecipientsFile      string
+	GPGRecipientsFile      string
+	AgeIdentityFile        string
+	GPGSecretKeyFile       string
+	GPGPassphrase          string
+
+	// SQLite WAL shipping
+	WALShipping           bool
+	WALShippingInterval   time.Duration
+	WALGenerationInterval time.Duration
+	WatchChanges          bool
+	WatchDebounce         time.Duration
+
+	StorageBackends []string
+	KeyPrefix       string
+	KeyPrefixes     map[string]string
+	ObjectTags      map[string]string
+	FailoverBackend string
+	UploadRetries   int
+	SplitSize       int64
+
+	// Deployment files bundled with the backups
+	BundleFiles      string
+	BundleRedactKeys string
+
+	// PostgreSQL source
+	PGConnectionString string
+	PGDumpBinary       string
+	PGDumpExtraArgs    string
+	PGBackupMode       string
+	PGBasebackupBinary string
+
+	// MySQL / MariaDB source
+	MySQLDSN           string
+	MySQLDumpBinary    string
+	MySQLDumpExtraArgs string
+
+	// MongoDB source
+	MongoDBURI         string
+	MongoDBDatabase    string
+	MongoDumpBinary    string
+	MongoDumpExtraArgs string
+
+	// ClickHouse source
+	ClickHouseURL      string
+	ClickHouseDatabase string
+
+	// CouchDB source
+	CouchDBURL       string
+	CouchDBDatabases string
+
+	// Custom command source
+	ExecCommand   string
+	ExecExtension string
+
+	// Redis source
+	RedisURL     string
+	RedisRDBFile string
+
+	// Directory source
+	DirPath       string
+	DirInclude    string
+	DirExclude    string
+	DirIgnoreFile string
+
+	// Docker label discovery
+	DockerHost        string
+	DockerLabelPrefix string
+
+	// Kubernetes volume snapshots
+	K8sSnapshotPVC     string
+	K8sSnapshotClass   string
+	K8sNamespace       string
+	K8sSnapshotKeep    int
+	K8sSnapshotTimeout time.Duration
+
+	// Dump tools run inside another container with docker exec
+	DockerExecContainer string
+
+	// Replication into a second bucket of the primary S3-compatible backend
+	ReplicaBucket        string
+	ReplicaRegion        string
+	ReplicaRetentionDays int
+
+	// Cloudflare R2
+	R2AccessKeyID     string
+	R2SecretAccessKey string
+	R2AccountID       string
+	R2Bucket          string
+
+	// S3-compatible storage
+	S3Endpoint        string
+	S3Region          string
+	S3ForcePathStyle  bool
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	StorageClass      string
+	S3ObjectTagging   bool
+	ObjectLockMode    string
+	ObjectLockDays    int
+	ObjectLegalHold   bool
+	SSECustomerKey    string
+
+	// Google Cloud Storage
+	GCSBucket          string
+	GCSCredentialsFile string
+
+	// Backblaze B2
+	B2KeyID          string
+	B2ApplicationKey string
+	B2Bucket         string
+
+	// SFTP
+	SFTPHost                 string
+	SFTPPort                 string
+	SFTPUser                 string
+	SFTPPassword             string
+	SFTPPrivateKeyFile       string
+	SFTPPrivateKeyPassphrase string
+	SFTPKnownHostsFile       string
+	SFTPHostKeyFingerprint   string
+	SFTPDir                  string
+
+	// Local directory
+	LocalDir string
+
+	// WebDAV
+	WebDAVURL      string
+	WebDAVUser     string
+	WebDAVPassword string
+	WebDAVDir      string
+
+	// FTP
+	FTPHost          string
+	FTPPort          string
+	FTPUser          string
+	FTPPassword      string
+	FTPDir           string
+	FTPTLS           string
+	FTPTLSSkipVerify bool
+	FTPDisableEPSV   bool
+
+	// Dropbox
+	DropboxAccessToken  string
+	DropboxRefreshToken string
+	DropboxAppKey       string
+	DropboxAppSecret    string
+	DropboxDir          string
+
+	// Google Drive
+	GDriveFolderID        string
+	GDriveCredentialsFile string
+	GDriveClientID        string
+	GDriveClientSecret    string
+	GDriveRefreshToken    string
+
+	// rclone
+	RcloneRemote    string
+	RcloneBinary    string
+	RcloneExtraArgs string
+}
+
+func loadConfig() (*Config, error) {
+	return loadConfigEnv(environment{})
+}
+
+// loadRestoreConfig returns the global configuration for restoring, in which
+// RESTORE_<VARIABLE> overrides <VARIABLE>.
+func loadRestoreConfig() (*Config, error) {
+	return loadConfigEnv(environment{restore: true})
+}
+
+// restoreConfig returns the configuration of the source block of cfg for
+// restoring.
+func restoreConfig(cfg *Config) (*Config, error) {
+	env := environment{restore: true}
+	if cfg.Block != "" {
+		env.block = "SOURCE_" + envName(cfg.Block) + "_"
+	}
+
+	restore, err := loadConfigEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	restore.Block = cfg.Block
+
+	return restore, nil
+}
+
+// loadConfigs returns the configuration of every source block listed in
+// SOURCES, or just the global configuration if SOURCES is not set. A block
+// named app takes every setting from SOURCE_APP_<VARIABLE> if that is set, and
+// from <VARIABLE> otherwise, so each block can have its own source type,
+// schedule, retention, key prefix or even storage backend.
+func loadConfigs() ([]*Config, error) {
+	return loadConfigsEnv(false)
+}
+
+// loadRestoreConfigs returns the configuration of every source block like
+// loadConfigs, for restoring.
+func loadRestoreConfigs() ([]*Config, error) {
+	return loadConfigsEnv(true)
+}
+
+func loadConfigsEnv(restore bool) ([]*Config, error) {
+	blocks := splitList(os.Getenv("SOURCES"))
+	if len(blocks) == 0 {
+		cfg, err := loadConfigEnv(environment{restore: restore})
+		if err != nil {
+			return nil, err
+		}
+		return []*Config{cfg}, nil
+	}
+
+	seen := map[string]bool{}
+	configs := make([]*Config, 0, len(blocks))
+	for _, block := range blocks {
+		prefix := "SOURCE_" + envName(block) + "_"
+		if seen[prefix] {
+			return nil, fmt.Errorf("source block %s is listed twice", block)
+		}
+		seen[prefix] = true
+
+		cfg, err := loadConfigEnv(environment{block: prefix, restore: restore})
+		if err != nil {
+			return nil, fmt.Errorf("source block %s: %w", block, err)
+		}
+		cfg.Block = block
+		configs = append(configs, cfg)
+	}
+
+	return configs, nil
+}
+
+// envName turns name into the form used in environment variable names, in
+// upper case with anything but letters and digits replaced by underscores.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// loadConfigEnv loads the configuration from env.
+func loadConfigEnv(env environment) (*Config, error) {
+	cfg := &Config{
+		SourceTypes:     splitList(env.get("SOURCE_TYPE", "sqlite")),
+		SourceName:      env.lookup("SOURCE_NAME"),
+		Compression:     strings.ToLower(env.get("COMPRESSION", "gzip")),
+		DBPath:          env.lookup("DB_PATH"),
+		HostDBPath:      env.lookup("HOST_DB_PATH"),
+		BackupDir:       env.get("BACKUP_DIR", "/backups"),
+		BackupMode:      strings.ToLower(env.get("SQLITE_BACKUP_MODE", "backup")),
+		IntegrityCheck:  strings.ToLower(env.get("SQLITE_INTEGRITY_CHECK", "off")),
+		RetentionDays:   30, // default value
+		StorageBackends: splitList(env.get("STORAGE_BACKEND", "r2")),
+		KeyPrefix:       env.get("KEY_PREFIX", "backups/"),
+		KeyPrefixes:     env.prefixed("KEY_PREFIX_"),
+		ArchivePrefix:   env.get("RETENTION_ARCHIVE_PREFIX", "archive/"),
+		FailoverBackend: env.lookup("FAILOVER_STORAGE_BACKEND"),
+		UploadRetries:   2,
+
+		SkipInitialBackup: true,
+		StateDir:          env.lookup("STATE_DIR"),
+		PauseFile:         env.lookup("PAUSE_FILE"),
+		VerifySchedule:    env.lookup("VERIFY_SCHEDULE"),
+
+		RestorePreCommand:  env.lookup("RESTORE_PRE_COMMAND"),
+		RestorePostCommand: env.lookup("RESTORE_POST_COMMAND"),
+		HTTPAddr:           env.lookup("HTTP_ADDR"),
+		HTTPToken:          env.lookup("HTTP_TOKEN"),
+		HealthAddr:         env.lookup("HEALTH_ADDR"),
+		HealthGrace:        time.Hour,
+
+		Encryption:             strings.ToLower(env.get("ENCRYPTION", "none")),
+		EncryptionKey:          env.lookup("ENCRYPTION_KEY"),
+		EncryptionPreviousKeys: env.lookup("ENCRYPTION_PREVIOUS_KEYS"),
+		AgeRecipients:          env.lookup("AGE_RECIPIENTS"),
+		AgeRecipientsFile:      env.lookup("AGE_RECIPIENTS_FILE"),
+		GPGRecipientsFile:      env.lookup("GPG_RECIPIENTS_FILE"),
+		AgeIdentityFile:        env.lookup("AGE_IDENTITY_FILE"),
+		GPGSecretKeyFile:       env.lookup("GPG_SECRET_KEY_FILE"),
+		GPGPassphrase:          env.lookup("GPG_PASSPHRASE"),
+
+		BundleFiles:      env.lookup("BUNDLE_FILES"),
+		BundleRedactKeys: env.get("BUNDLE_REDACT_KEYS", "*PASSWORD*,*SECRET*,*TOKEN*,*KEY*,*CREDENTIAL*"),
+
+		WALShippingInterval:   10 * time.Second,
+		WALGenerationInterval: time.Hour,
+		WatchDebounce:         time.Minute,
+
+		PGConnectionString: env.lookup("PG_CONNECTION_STRING"),
+		PGDumpBinary:       env.get("PG_DUMP_BINARY", "pg_dump"),
+		PGDumpExtraArgs:    env.lookup("PG_DUMP_EXTRA_ARGS"),
+		PGBackupMode:       strings.ToLower(env.get("PG_BACKUP_MODE", "dump")),
+		PGBasebackupBinary: env.get("PG_BASEBACKUP_BINARY", "pg_basebackup"),
+
+		MySQLDSN:           env.lookup("MYSQL_DSN"),
+		MySQLDumpBinary:    env.get("MYSQLDUMP_BINARY", "mysqldump"),
+		MySQLDumpExtraArgs: env.lookup("MYSQLDUMP_EXTRA_ARGS"),
+
+		MongoDBURI:         env.lookup("MONGODB_URI"),
+		MongoDBDatabase:    env.lookup("MONGODB_DATABASE"),
+		MongoDumpBinary:    env.get("MONGODUMP_BINARY", "mongodump"),
+		MongoDumpExtraArgs: env.lookup("MONGODUMP_EXTRA_ARGS"),
+
+		ClickHouseURL:      env.lookup("CLICKHOUSE_URL"),
+		ClickHouseDatabase: env.lookup("CLICKHOUSE_DATABASE"),
+
+		CouchDBURL:       env.lookup("COUCHDB_URL"),
+		CouchDBDatabases: env.lookup("COUCHDB_DATABASES"),
+
+		ExecCommand:   env.lookup("EXEC_COMMAND"),
+		ExecExtension: env.get("EXEC_EXTENSION", ".bin"),
+
+		RedisURL:     env.lookup("REDIS_URL"),
+		RedisRDBFile: env.lookup("REDIS_RDB_FILE"),
+
+		DirPath:       env.lookup("DIR_PATH"),
+		DirInclude:    env.lookup("DIR_INCLUDE"),
+		DirExclude:    env.lookup("DIR_EXCLUDE"),
+		DirIgnoreFile: env.get("DIR_IGNORE_FILE", ".backupignore"),
+
+		DockerHost:        env.get("DOCKER_HOST", "unix:///var/run/docker.sock"),
+		DockerLabelPrefix: env.get("DOCKER_LABEL_PREFIX", "backup"),
+
+		DockerExecContainer: env.lookup("DOCKER_EXEC_CONTAINER"),
+
+		K8sSnapshotPVC:     env.lookup("K8S_SNAPSHOT_PVC"),
+		K8sSnapshotClass:   env.lookup("K8S_SNAPSHOT_CLASS"),
+		K8sNamespace:       env.lookup("K8S_NAMESPACE"),
+		K8sSnapshotKeep:    7,
+		K8sSnapshotTimeout: 5 * time.Minute,
+
+		ReplicaBucket: env.lookup("REPLICA_BUCKET"),
+		ReplicaRegion: env.lookup("REPLICA_REGION"),
+
+		R2AccessKeyID:     env.lookup("R2_ACCESS_KEY_ID"),
+		R2SecretAccessKey: env.lookup("R2_SECRET_ACCESS_KEY"),
+		R2AccountID:       env.lookup("R2_ACCOUNT_ID"),
+		R2Bucket:          env.lookup("R2_BUCKET"),
+
+		S3Endpoint:        env.lookup("S3_ENDPOINT"),
+		S3Region:          env.lookup("S3_REGION"),
+		S3Bucket:          env.lookup("S3_BUCKET"),
+		S3AccessKeyID:     env.lookup("S3_ACCESS_KEY_ID"),
+		S3SecretAccessKey: env.lookup("S3_SECRET_ACCESS_KEY"),
+		StorageClass:      env.lookup("STORAGE_CLASS"),
+		ObjectLockMode:    strings.ToUpper(env.lookup("OBJECT_LOCK_MODE")),
+		SSECustomerKey:    env.lookup("SSE_C_KEY"),
+
+		GCSBucket:          env.lookup("GCS_BUCKET"),
+		GCSCredentialsFile: env.lookup("GCS_CREDENTIALS_FILE"),
+
+		B2KeyID:          env.lookup("B2_KEY_ID"),
+		B2ApplicationKey: env.lookup("B2_APPLICATION_KEY"),
+		B2Bucket:         env.lookup("B2_BUCKET"),
+
+		SFTPHost:                 env.lookup("SFTP_HOST"),
+		SFTPPort:                 env.get("SFTP_PORT", "22"),
+		SFTPUser:                 env.lookup("SFTP_USER"),
+		SFTPPassword:             env.lookup("SFTP_PASSWORD"),
+		SFTPPrivateKeyFile:       env.lookup("SFTP_PRIVATE_KEY_FILE"),
+		SFTPPrivateKeyPassphrase: env.lookup("SFTP_PRIVATE_KEY_PASSPHRASE"),
+		SFTPKnownHostsFile:       env.lookup("SFTP_KNOWN_HOSTS_FILE"),
+		SFTPHostKeyFingerprint:   env.lookup("SFTP_HOST_KEY_FINGERPRINT"),
+		SFTPDir:                  env.get("SFTP_DIR", "."),
+
+		LocalDir: env.lookup("LOCAL_DIR"),
+
+		WebDAVURL:      env.lookup("WEBDAV_URL"),
+		WebDAVUser:     env.lookup("WEBDAV_USER"),
+		WebDAVPassword: env.lookup("WEBDAV_PASSWORD"),
+		WebDAVDir:      env.lookup("WEBDAV_DIR"),
+
+		FTPHost:     env.lookup("FTP_HOST"),
+		FTPPort:     env.get("FTP_PORT", "21"),
+		FTPUser:     env.lookup("FTP_USER"),
+		FTPPassword: env.lookup("FTP_PASSWORD"),
+		FTPDir:      env.lookup("FTP_DIR"),
+		FTPTLS:      env.lookup("FTP_TLS"),
+
+		DropboxAccessToken:  env.lookup("DROPBOX_ACCESS_TOKEN"),
+		DropboxRefreshToken: env.lookup("DROPBOX_REFRESH_TOKEN"),
+		DropboxAppKey:       env.lookup("DROPBOX_APP_KEY"),
+		DropboxAppSecret:    env.lookup("DROPBOX_APP_SECRET"),
+		DropboxDir:          env.lookup("DROPBOX_DIR"),
+
+		GDriveFolderID:        env.lookup("GDRIVE_FOLDER_ID"),
+		GDriveCredentialsFile: env.lookup("GDRIVE_CREDENTIALS_FILE"),
+		GDriveClientID:        env.lookup("GDRIVE_CLIENT_ID"),
+		GDriveClientSecret:    env.lookup("GDRIVE_CLIENT_SECRET"),
+		GDriveRefreshToken:    env.lookup("GDRIVE_REFRESH_TOKEN"),
+
+		RcloneRemote:    env.lookup("RCLONE_REMOTE"),
+		RcloneBinary:    env.get("RCLONE_BINARY", "rclone"),
+		RcloneExtraArgs: env.lookup("RCLONE_EXTRA_ARGS"),
+	}
+
+	boolVars := map[string]*bool{
+		"SQLITE_WAL_CHECKPOINT": &cfg.WALCheckpoint,
+		"WAL_SHIPPING":          &cfg.WALShipping,
+		"WATCH_CHANGES":         &cfg.WatchChanges,
+		"SKIP_INITIAL_BACKUP":   &cfg.SkipInitialBackup,
+		"CATCH_UP":              &cfg.CatchUp,
+		"RETENTION_DRY_RUN":     &cfg.RetentionDryRun,
+		"BUCKET_LIFECYCLE":      &cfg.BucketLifecycle,
+		"BOOTSTRAP_RESTORE":     &cfg.BootstrapRestore,
+		"S3_FORCE_PATH_STYLE":   &cfg.S3ForcePathStyle,
+		"S3_OBJECT_TAGGING":     &cfg.S3ObjectTagging,
+		"OBJECT_LEGAL_HOLD":     &cfg.ObjectLegalHold,
+		"FTP_TLS_SKIP_VERIFY":   &cfg.FTPTLSSkipVerify,
+		"FTP_DISABLE_EPSV":      &cfg.FTPDisableEPSV,
+	}
+	for name, dst := range boolVars {
+		if err := env.parseBool(name, dst); err != nil {
+			return nil, err
+		}
+	}
+
+	// Secrets can also be read from a file named by the variable with _FILE
+	// appended, such as a Docker or Kubernetes secret mount, to keep them out
+	// of the environment.
+	secretVars := map[string]*string{
+		"ENCRYPTION_KEY":              &cfg.EncryptionKey,
+		"ENCRYPTION_PREVIOUS_KEYS":    &cfg.EncryptionPreviousKeys,
+		"GPG_PASSPHRASE":              &cfg.GPGPassphrase,
+		"HTTP_TOKEN":                  &cfg.HTTPToken,
+		"PG_CONNECTION_STRING":        &cfg.PGConnectionString,
+		"MYSQL_DSN":                   &cfg.MySQLDSN,
+		"MONGODB_URI":                 &cfg.MongoDBURI,
+		"CLICKHOUSE_URL":              &cfg.ClickHouseURL,
+		"COUCHDB_URL":                 &cfg.CouchDBURL,
+		"REDIS_URL":                   &cfg.RedisURL,
+		"R2_ACCESS_KEY_ID":            &cfg.R2AccessKeyID,
+		"R2_SECRET_ACCESS_KEY":        &cfg.R2SecretAccessKey,
+		"S3_ACCESS_KEY_ID":            &cfg.S3AccessKeyID,
+		"S3_SECRET_ACCESS_KEY":        &cfg.S3SecretAccessKey,
+		"SSE_C_KEY":                   &cfg.SSECustomerKey,
+		"B2_KEY_ID":                   &cfg.B2KeyID,
+		"B2_APPLICATION_KEY":          &cfg.B2ApplicationKey,
+		"SFTP_PASSWORD":               &cfg.SFTPPassword,
+		"SFTP_PRIVATE_KEY_PASSPHRASE": &cfg.SFTPPrivateKeyPassphrase,
+		"WEBDAV_PASSWORD":             &cfg.WebDAVPassword,
+		"FTP_PASSWORD":                &cfg.FTPPassword,
+		"DROPBOX_ACCESS_TOKEN":        &cfg.DropboxAccessToken,
+		"DROPBOX_REFRESH_TOKEN":       &cfg.DropboxRefreshToken,
+		"DROPBOX_APP_SECRET":          &cfg.DropboxAppSecret,
+		"GDRIVE_CLIENT_SECRET":        &cfg.GDriveClientSecret,
+		"GDRIVE_REFRESH_TOKEN":        &cfg.GDriveRefreshToken,
+	}
+	for name, dst := range secretVars {
+		if err := env.readSecretFile(name, dst); err != nil {
+			return nil, err
+		}
+	}
+
+	objectTags, err := parseKeyValueList(env.lookup("OBJECT_TAGS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OBJECT_TAGS: %w", err)
+	}
+	cfg.ObjectTags = objectTags
+
+	intVars := map[string]*int{
+		"RETENTION_DAYS":         &cfg.RetentionDays,
+		"RETENTION_COUNT":        &cfg.RetentionCount,
+		"RETENTION_MIN_COUNT":    &cfg.RetentionMinCount,
+		"RETENTION_DAILY":        &cfg.RetentionDaily,
+		"RETENTION_WEEKLY":       &cfg.RetentionWeekly,
+		"RETENTION_MONTHLY":      &cfg.RetentionMonthly,
+		"RETENTION_YEARLY":       &cfg.RetentionYearly,
+		"RETENTION_ARCHIVE_DAYS": &cfg.ArchiveDays,
+		"COMPRESSION_LEVEL":      &cfg.CompressionLevel,
+		"COMPRESSION_THREADS":    &cfg.CompressionThreads,
+		"UPLOAD_RETRIES":         &cfg.UploadRetries,
+		"OBJECT_LOCK_DAYS":       &cfg.ObjectLockDays,
+		"K8S_SNAPSHOT_KEEP":      &cfg.K8sSnapshotKeep,
+		"KEEP_LOCAL_BACKUPS":     &cfg.KeepLocalBackups,
+		"LOCAL_RETENTION_DAYS":   &cfg.LocalRetentionDays,
+	}
+	for name, dst := range intVars {
+		if err := env.parseInt(name, dst); err != nil {
+			return nil, err
+		}
+	}
+	// The newest snapshot is the one just taken for the backup.
+	if cfg.K8sSnapshotKeep < 1 {
+		return nil, fmt.Errorf("invalid K8S_SNAPSHOT_KEEP %d (expected at least 1)", cfg.K8sSnapshotKeep)
+	}
+
+	if err := env.parseSize("SPLIT_SIZE", &cfg.SplitSize); err != nil {
+		return nil, err
+	}
+	if err := env.parseSize("RETENTION_MAX_SIZE", &cfg.RetentionMaxSize); err != nil {
+		return nil, err
+	}
+
+	durationVars := map[string]*time.Duration{
+		"WAL_SHIPPING_INTERVAL":   &cfg.WALShippingInterval,
+		"WAL_GENERATION_INTERVAL": &cfg.WALGenerationInterval,
+		"WATCH_DEBOUNCE":          &cfg.WatchDebounce,
+		"K8S_SNAPSHOT_TIMEOUT":    &cfg.K8sSnapshotTimeout,
+		"HEALTH_GRACE":            &cfg.HealthGrace,
+	}
+	for name, dst := range durationVars {
+		if err := env.parseDuration(name, dst); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.Location = time.Local
+	if name := env.lookup("BACKUP_TZ"); name != "" {
+		if cfg.Location, err = time.LoadLocation(name); err != nil {
+			return nil, fmt.Errorf("invalid BACKUP_TZ %q: %w", name, err)
+		}
+	}
+
+	// BACKUP_SCHEDULES replaces BACKUP_SCHEDULE with several tiers, and
+	// BACKUP_INTERVAL with a fixed interval.
+	var interval time.Duration
+	if err := env.parseDuration("BACKUP_INTERVAL", &interval); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		if env.lookup("BACKUP_SCHEDULE") != "" || env.lookup("BACKUP_SCHEDULES") != "" {
+			return nil, fmt.Errorf("BACKUP_INTERVAL can't be combined with BACKUP_SCHEDULE or BACKUP_SCHEDULES")
+		}
+		cfg.Schedules = []backupSchedule{{Spec: "@every " + interval.String()}}
+	} else if value := env.lookup("BACKUP_SCHEDULES"); value != "" {
+		if cfg.Schedules, err = parseSchedules(value); err != nil {
+			return nil, fmt.Errorf("invalid BACKUP_SCHEDULES: %w", err)
+		}
+	} else {
+		schedule := env.get("BACKUP_SCHEDULE", "0 2 * * *")
+		if _, err := cronParser.Parse(schedule); err != nil {
+			return nil, fmt.Errorf("invalid BACKUP_SCHEDULE %q: %w", schedule, err)
+		}
+		cfg.Schedules = []backupSchedule{{Spec: schedule}}
+	}
+
+	// RETENTION_DAYS_<TIER> keeps the backups of a tier for another number
+	// of days, with the - in tier names written as _. Global variables apply
+	// to every source block, which don't all have the same tiers, so only
+	// the ones set for the block itself must match one of its tiers.
+	tiers := map[string]bool{}
+	for _, schedule := range cfg.Schedules {
+		tiers[schedule.Tier] = true
+	}
+	global := map[string]string{}
+	if env.block != "" {
+		global = environment{restore: env.restore}.prefixed("RETENTION_DAYS_")
+	}
+	cfg.TierRetentionDays = map[string]int{}
+	for name, value := range env.prefixed("RETENTION_DAYS_") {
+		tier := strings.ReplaceAll(name, "_", "-")
+		if !tiers[tier] || tier == "" {
+			if global[name] == value {
+				continue
+			}
+			return nil, fmt.Errorf("RETENTION_DAYS_%s doesn't match a tier of BACKUP_SCHEDULES", strings.ToUpper(name))
+		}
+		days, err := strconv.Atoi(value)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid RETENTION_DAYS_%s %q (expected a positive number of days)", strings.ToUpper(name), value)
+		}
+		cfg.TierRetentionDays[tier] = days
+	}
+
+	if cfg.VerifySchedule != "" {
+		if _, err := cronParser.Parse(cfg.VerifySchedule); err != nil {
+			return nil, fmt.Errorf("invalid VERIFY_SCHEDULE %q: %w", cfg.VerifySchedule, err)
+		}
+	}
+
+	switch cfg.BackupMode {
+	case "backup", "vacuum":
+	default:
+		return nil, fmt.Errorf("invalid SQLITE_BACKUP_MODE %q (expected backup or vacuum)", cfg.BackupMode)
+	}
+
+	switch cfg.IntegrityCheck {
+	case "off", "quick", "full":
+	default:
+		return nil, fmt.Errorf("invalid SQLITE_INTEGRITY_CHECK %q (expected off, quick or full)", cfg.IntegrityCheck)
+	}
+
+	switch cfg.PGBackupMode {
+	case "dump", "basebackup":
+	default:
+		return nil, fmt.Errorf("invalid PG_BACKUP_MODE %q (expected dump or basebackup)", cfg.PGBackupMode)
+	}
+
+	switch cfg.ObjectLockMode {
+	case "":
+		if cfg.ObjectLockDays > 0 {
+			return nil, fmt.Errorf("OBJECT_LOCK_DAYS requires OBJECT_LOCK_MODE to be set")
+		}
+	case "GOVERNANCE", "COMPLIANCE":
+		if cfg.ObjectLockDays <= 0 {
+			return nil, fmt.Errorf("OBJECT_LOCK_MODE requires OBJECT_LOCK_DAYS to be set")
+		}
+	default:
+		return nil, fmt.Errorf("invalid OBJECT_LOCK_MODE %q (expected GOVERNANCE or COMPLIANCE)", cfg.ObjectLockMode)
+	}
+
+	cfg.ReplicaRetentionDays = cfg.RetentionDays
+	if err := env.parseInt("REPLICA_RETENTION_DAYS", &cfg.ReplicaRetentionDays); err != nil {
+		return nil, err
+	}
+
+	// Source and backend specific settings, such as DB_PATH, are validated by
+	// the source or storage backend itself.
+	return cfg, nil
+}
+
+// environment looks up configuration variables. For a source block it looks
+// up the block's SOURCE_<NAME>_ variables first, falling back to the global
+// ones.
+type environment struct {
+	// block is the SOURCE_<NAME>_ prefix of a source block, empty for the
+	// global configuration.
+	block string
+	// restore looks up the RESTORE_ variant of every variable first, so
+	// restores can read from another bucket, with other credentials, than
+	// backups are written to.
+	restore bool
+}
+
+// lookup returns the value of the environment variable name. In a source
+// block, SOURCE_TYPE is overridden as SOURCE_<NAME>_TYPE rather than
+// SOURCE_<NAME>_SOURCE_TYPE, and SOURCE_NAME as SOURCE_<NAME>_NAME, which
+// isn't inherited, as names must be unique. For restores, RESTORE_<VARIABLE>
+// and RESTORE_SOURCE_<NAME>_<VARIABLE> override both.
+func (e environment) lookup(name string) string {
+	if e.restore {
+		if e.block != "" {
+			if value := os.Getenv("RESTORE_" + e.block + strings.TrimPrefix(name, "SOURCE_")); value != "" {
+				return value
+			}
+		}
+		if value := os.Getenv("RESTORE_" + name); value != "" && (e.block == "" || name != "SOURCE_NAME") {
+			return value
+		}
+	}
+
+	if e.block == "" {
+		return os.Getenv(name)
+	}
+
+	override := e.block + strings.TrimPrefix(name, "SOURCE_")
+	if value := os.Getenv(override); value != "" || name == "SOURCE_NAME" {
+		return value
+	}
+
+	return os.Getenv(name)
+}
+
+// get returns the value of the environment variable name, or fallback if it
+// is unset or empty.
+func (e environment) get(name, fallback string) string {
+	if value := e.lookup(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// prefixed returns all environment variables starting with prefix, keyed by
+// the rest of their name in lower case (KEY_PREFIX_SFTP becomes "sftp").
+func (e environment) prefixed(prefix string) map[string]string {
+	vars := map[string]string{}
+	prefixes := []string{prefix}
+	if e.block != "" {
+		prefixes = append(prefixes, e.block+prefix)
+	}
+	if e.restore {
+		prefixes = append(prefixes, "RESTORE_"+prefix)
+		if e.block != "" {
+			prefixes = append(prefixes, "RESTORE_"+e.block+prefix)
+		}
+	}
+
+	// The block's and the RESTORE_ variables come last, so they win.
+	for _, p := range prefixes {
+		for _, env := range os.Environ() {
+			name, value, _ := strings.Cut(env, "=")
+			if strings.HasPrefix(name, p) && value != "" {
+				vars[strings.ToLower(strings.TrimPrefix(name, p))] = value
+			}
+		}
+	}
+
+	return vars
+}
+
+// backupSchedule is a cron expression backups run on. Backups of a tier, such
+// as hourly or weekly, carry its name in their object key.
+type backupSchedule struct {
+	Tier string
+	Spec string
+}
+
+// cronParser parses schedules: standard cron expressions, which may start
+// with an optional seconds field for backups more frequent than once a
+// minute, and descriptors like @daily.
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// parseSchedules parses a semicolon separated list of tier=cron pairs, like
+// "hourly=0 * * * *;daily=0 2 * * *". Cron expressions can contain commas, so
+// they can't be separated by commas like other lists.
+func parseSchedules(value string) ([]backupSchedule, error) {
+	var schedules []backupSchedule
+	seen := map[string]bool{}
+	for _, item := range strings.Split(value, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		tier, spec, ok := strings.Cut(item, "=")
+		tier, spec = strings.ToLower(strings.TrimSpace(tier)), strings.TrimSpace(spec)
+		if !ok || tier == "" {
+			return nil, fmt.Errorf("expected tier=schedule, got %q", item)
+		}
+		if strings.Trim(tier, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return nil, fmt.Errorf("invalid tier %q (expected letters, digits and -)", tier)
+		}
+		if seen[tier] {
+			return nil, fmt.Errorf("duplicate tier %q", tier)
+		}
+		seen[tier] = true
+
+		if _, err := cronParser.Parse(spec); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q of tier %s: %w", spec, tier, err)
+		}
+		schedules = append(schedules, backupSchedule{Tier: tier, Spec: spec})
+	}
+	if len(schedules) == 0 {
+		return nil, fmt.Errorf("no schedules")
+	}
+
+	return schedules, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// parseKeyValueList parses a comma separated list of key=value pairs.
+func parseKeyValueList(value string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, item := range splitList(value) {
+		k, v, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", item)
+		}
+		pairs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return pairs, nil
+}
+
+// readSecretFile sets dst from the file named by the environment variable
+// name with _FILE appended, unless name itself is set. A trailing newline, as
+// left by most editors and echo, is dropped.
+func (e environment) readSecretFile(name string, dst *string) error {
+	path := e.lookup(name + "_FILE")
+	if *dst != "" || path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	*dst = strings.TrimRight(string(data), "\r\n")
+
+	return nil
+}
+
+// parseBool sets dst from the environment variable name if it is set,
+// leaving the default in dst untouched otherwise.
+func (e environment) parseBool(name string, dst *bool) error {
+	value := e.lookup(name)
+	if value == "" {
+		return nil
+	}
+
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = v
+
+	return nil
+}
+
+// parseInt sets dst from the environment variable name if it is set,
+// leaving the default in dst untouched otherwise.
+func (e environment) parseInt(name string, dst *int) error {
+	value := e.lookup(name)
+	if value == "" {
+		return nil
+	}
+
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = v
+
+	return nil
+}
+
+// parseDuration sets dst from the environment variable name if it is set,
+// leaving the default in dst untouched otherwise.
+func (e environment) parseDuration(name string, dst *time.Duration) error {
+	value := e.lookup(name)
+	if value == "" {
+		return nil
+	}
+
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if v <= 0 {
+		return fmt.Errorf("invalid %s: must be positive", name)
+	}
+	*dst = v
+
+	return nil
+}
+
+// parseSize sets dst from the environment variable name if it is set, as a
+// number of bytes with an optional KB, MB, GB or TB suffix (powers of 1024),
+// leaving the default in dst untouched otherwise.
+func (e environment) parseSize(name string, dst *int64) error {
+	value := e.lookup(name)
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	v, err := parseSize(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = v
+
+	return nil
+}
+
+// parseSize parses a positive size in bytes, with an optional KB, MB, GB or
+// TB suffix in powers of 1024.
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(value, suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, suffix))
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	value = strings.TrimSuffix(value, "B")
+
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+
+	return v * multiplier, nil
+}
+
+func checkRequired(required map[string]string) error {
+	for name, value := range required {
+		if value == "" {
+			return fmt.Errorf("required environment variable %s is not set", name)
+		}
+	}
+
+	return nil
+}
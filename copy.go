@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// runCopy implements the copy command, which copies the backups of every
+// source from one storage backend to another under the same keys, along with
+// their metadata, catalog and latest pointer, e.g. to migrate from R2 to an SFTP server:
+//
+//	backup-app copy r2 sftp
+//
+// Both backends are configured with their usual variables, they don't have
+// to be listed in STORAGE_BACKEND. Backups that are already on the target
+// with the same size are skipped, so an interrupted copy can be run again.
+func runCopy(args []string) {
+	flags := flag.NewFlagSet("copy", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the backups that would be copied without copying them")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fatalf("Usage: copy [--dry-run] <from backend> <to backend>")
+	}
+	from, to := flags.Arg(0), flags.Arg(1)
+
+	configs, err := loadConfigs()
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, cfg := range configs {
+		fromStorage, err := newStorageBackend(from, cfg)
+		if err != nil {
+			fatalf("Failed to create storage backend: %s: %v", from, err)
+		}
+		toStorage, err := newStorageBackend(to, cfg)
+		if err != nil {
+			fatalf("Failed to create storage backend: %s: %v", to, err)
+		}
+		sources, err := newSources(cfg)
+		if err != nil {
+			fatalf("Failed to create backup source: %v", err)
+		}
+
+		for _, source := range sources {
+			src := Destination{Name: from, Storage: fromStorage, KeyPrefix: keyPrefixFor(cfg, from)}
+			dst := Destination{Name: to, Storage: toStorage}
+			if err := copyBackups(ctx, src, dst, source.Name(), *dryRun); err != nil {
+				fatalf("Failed to copy backups of %s: %v", source.Name(), err)
+			}
+		}
+	}
+}
+
+// copyBackups copies the backups of dbName, including the parts and
+// manifests of split backups, from src to the same keys on dst, followed by
+// the catalog and latest pointer of dbName. Backups already on dst with the
+// same size are skipped.
+func copyBackups(ctx context.Context, src, dst Destination, dbName string, dryRun bool) error {
+	prefix := listPrefix(src.KeyPrefix, dbName)
+	objects, err := src.Storage.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	stored, err := dst.Storage.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	logger := slog.With("job", "copy", "source", dbName, "from", src.Name, "destination", dst.Name)
+	existing := map[string]int64{}
+	for _, obj := range stored {
+		existing[obj.Key] = obj.Size
+	}
+
+	var backups, pointers []BackupObject
+	for _, obj := range objects {
+		switch name := path.Base(obj.Key); {
+		case name == dbName+"_catalog.json", name == dbName+"_latest.json":
+			pointers = append(pointers, obj)
+		case strings.HasPrefix(name, dbName+"_backup_"):
+			if size, ok := existing[obj.Key]; ok && size == obj.Size {
+				logger.Info("Backup is already on the destination", "key", obj.Key)
+				continue
+			}
+			backups = append(backups, obj)
+		}
+	}
+	// The catalog and latest pointer are copied last, so they never point
+	// to a backup that isn't on dst yet.
+	backups = append(backups, pointers...)
+
+	for _, obj := range backups {
+		if dryRun {
+			logger.Info("Dry run: would copy backup", "key", obj.Key, "bytes", obj.Size)
+			continue
+		}
+		if err := copyObject(ctx, src, dst, obj); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", obj.Key, err)
+		}
+		logger.Info("Copied backup", "key", obj.Key, "bytes", obj.Size)
+	}
+
+	return nil
+}
+
+// copyObject copies obj from src to dst, with its metadata where the backend
+// of src returns it.
+func copyObject(ctx context.Context, src, dst Destination, obj BackupObject) error {
+	var metadata map[string]string
+	if reader, ok := src.Storage.(MetadataReader); ok {
+		var err error
+		if metadata, err = reader.Metadata(ctx, obj.Key); err != nil {
+			return err
+		}
+	}
+
+	body, err := src.Storage.Get(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return dst.Storage.Put(ctx, obj.Key, body, obj.Size, metadata)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// dockerClient talks to the Docker Engine API, over the Docker socket by
+// default. Only the few endpoints the service needs are implemented.
+type dockerClient struct {
+	httpClient *http.Client
+	baseURL    string
+}
+
+// dockerContainer is an entry of the container list.
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// Name returns the name of the container without the leading slash.
+func (c dockerContainer) Name() string {
+	if len(c.Names) == 0 {
+		return c.ID[:12]
+	}
+
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// newDockerClient creates a client for host, given like DOCKER_HOST as
+// unix:///var/run/docker.sock or tcp://host:2375.
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DOCKER_HOST: %w", err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		// The host name is ignored when dialing the socket.
+		return &dockerClient{httpClient: &http.Client{Transport: transport}, baseURL: "http://docker"}, nil
+	case "tcp", "http":
+		return &dockerClient{httpClient: &http.Client{}, baseURL: "http://" + u.Host}, nil
+	default:
+		return nil, fmt.Errorf("invalid DOCKER_HOST: unsupported scheme %q", u.Scheme)
+	}
+}
+
+// do sends a request to the API and returns the response if it succeeded.
+// The caller must close the body.
+func (c *dockerClient) do(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = strings.NewReader(string(payload))
+	}
+
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("docker API request failed: %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return nil, fmt.Errorf("docker API error %d: %s", resp.StatusCode, apiErr.Message)
+	}
+
+	return resp, nil
+}
+
+// listContainers returns the running containers that carry label, given as
+// name=value.
+func (c *dockerClient) listContainers(ctx context.Context, label string) ([]dockerContainer, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {label}})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/containers/json", url.Values{"filters": {string(filters)}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to decode container list: %w", err)
+	}
+
+	return containers, nil
+}
+
+// archive returns a tar archive of path inside a container.
+func (c *dockerClient) archive(ctx context.Context, id, path string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/containers/"+id+"/archive", url.Values{"path": {path}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// exec runs cmd with the environment variables env inside a running
+// container and copies its stdout to w. The returned error includes what the
+// command wrote to stderr.
+func (c *dockerClient) exec(ctx context.Context, id string, cmd, env []string, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodPost, "/containers/"+id+"/exec", nil, map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          cmd,
+		"Env":          env,
+	})
+	if err != nil {
+		return err
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode exec instance: %w", err)
+	}
+
+	// Without a TTY, stdout and stderr are multiplexed into the response
+	// body, which lasts until the command exits.
+	resp, err = c.do(ctx, http.MethodPost, "/exec/"+created.ID+"/start", nil, map[string]bool{"Detach": false, "Tty": false})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var stderr bytes.Buffer
+	if err := demuxDockerStream(resp.Body, w, &stderr); err != nil {
+		return err
+	}
+
+	resp, err = c.do(ctx, http.MethodGet, "/exec/"+created.ID+"/json", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var inspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return fmt.Errorf("failed to decode exec result: %w", err)
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("exit status %d: %s", inspect.ExitCode, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// demuxDockerStream splits a multiplexed stream into stdout and stderr. Every
+// frame starts with a header holding the stream, 1 for stdout and 2 for
+// stderr, in the first byte and the big endian frame size in the last four.
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		dst := stdout
+		if header[0] == 2 {
+			dst = stderr
+		}
+		if _, err := io.CopyN(dst, r, int64(binary.BigEndian.Uint32(header[4:8]))); err != nil {
+			return err
+		}
+	}
+}
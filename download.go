@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// runDownload implements the download command, which fetches a backup from
+// the primary destination as it is stored, still compressed and encrypted,
+// for inspecting it or copying it elsewhere:
+//
+//	backup-app download backups/app_backup_20240101_020000.sql.gz /tmp/
+func runDownload(args []string) {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	force := flags.Bool("force", false, "replace an existing file at the target path")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		fatalf("Usage: download [--force] <key> [target path]")
+	}
+	key, target := flags.Arg(0), flags.Arg(1)
+
+	// Without a target, or with a directory as the target, the backup keeps
+	// its name.
+	if target == "" {
+		target = path.Base(key)
+	} else if info, err := os.Stat(target); err == nil && info.IsDir() {
+		target = filepath.Join(target, path.Base(key))
+	}
+
+	cfg, err := loadRestoreConfig()
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	destinations, err := newDestinations(cfg)
+	if err != nil {
+		fatalf("Failed to create storage backend: %v", err)
+	}
+
+	if err := downloadBackup(context.Background(), destinations[0], key, target, *force); err != nil {
+		fatalf("Failed to download %s: %v", key, err)
+	}
+}
+
+// downloadBackup downloads the backup at key on dest to target, putting split
+// backups back together. Where the backend returns the sha256 metadata, the
+// download is checked against it. An existing file is only replaced with
+// force.
+func downloadBackup(ctx context.Context, dest Destination, key, target string, force bool) error {
+	if _, err := os.Stat(target); err == nil && !force {
+		return fmt.Errorf("%s already exists, download with --force to replace it", target)
+	}
+
+	r, err := openBackup(ctx, dest.Storage, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".download-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// CreateTemp creates files only the owner can read.
+	if err := tmp.Chmod(0644); err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), r)
+	if err != nil {
+		return fmt.Errorf("failed to download backup: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	if err := checkSHA256(ctx, dest, key, sum.Sum(nil)); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("failed to move download into place: %w", err)
+	}
+
+	slog.Info("Downloaded backup", "job", "download", "destination", dest.Name, "key", key, "bytes", size, "path", target)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+func init() {
+	registerEncryptor("none", newNoEncryptor)
+}
+
+// Encryptor encrypts backups after they are compressed, before they are
+// written to disk and uploaded, so neither the bucket nor anyone with access
+// to it can read them. Implementations register themselves by name with
+// registerEncryptor and are selected with the ENCRYPTION environment
+// variable.
+type Encryptor interface {
+	// Extension is appended to the file name of encrypted backups.
+	Extension() string
+	// NewWriter returns a writer encrypting into w. Closing it writes the
+	// remaining encrypted data, but doesn't close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+type encryptorFactory func(cfg *Config) (Encryptor, error)
+
+var encryptors = map[string]encryptorFactory{}
+
+func registerEncryptor(name string, factory encryptorFactory) {
+	encryptors[name] = factory
+}
+
+func newEncryptor(cfg *Config) (Encryptor, error) {
+	factory, ok := encryptors[cfg.Encryption]
+	if !ok {
+		names := make([]string, 0, len(encryptors))
+		for name := range encryptors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown encryption %q (available: %s)", cfg.Encryption, strings.Join(names, ", "))
+	}
+
+	return factory(cfg)
+}
+
+// decrypterFactory returns a reader decrypting r, for restores.
+type decrypterFactory func(cfg *Config, r io.Reader) (io.Reader, error)
+
+var decrypters = map[string]decrypterFactory{}
+
+// registerDecrypter registers how backups whose name ends in extension are
+// decrypted. Decrypting usually takes other keys than encrypting, like an age
+// identity rather than its recipient, so it is configured separately.
+func registerDecrypter(extension string, factory decrypterFactory) {
+	decrypters[extension] = factory
+}
+
+// noEncryptor leaves backups unencrypted, which is the default.
+type noEncryptor struct{}
+
+func newNoEncryptor(cfg *Config) (Encryptor, error) {
+	return noEncryptor{}, nil
+}
+
+func (noEncryptor) Extension() string { return "" }
+
+func (noEncryptor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+// gzipEncrypt compresses r with gzip and encrypts it with enc in memory, for
+// objects small enough not to need a temporary file, like WAL segments.
+func gzipEncrypt(r io.Reader, enc Encryptor) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	ew, err := enc.NewWriter(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %w", err)
+	}
+	gw := gzip.NewWriter(ew)
+	if _, err := io.Copy(gw, r); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	if err := ew.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %w", err)
+	}
+
+	return &buf, nil
+}
+
+// parseKey decodes the 256 bit key in the variable name, given in base64, as
+// generated by openssl rand -base64 32, or in hex.
+func parseKey(name, value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(value)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid %s: expected 32 bytes in base64 or hex", name)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func init() {
+	registerEncryptor("aes", newAESEncryptor)
+	registerDecrypter(".enc", newAESDecrypter)
+}
+
+// Encrypted backups start with a header of the magic bytes, the format
+// version, the ID of the key (since version 2) and a random nonce prefix. The
+// rest is the compressed backup in chunks of aesChunkSize bytes, each sealed
+// with AES-256-GCM on its own so backups of any size can be encrypted and
+// decrypted as a stream. The nonce of a chunk is the prefix, the chunk number
+// and a flag marking the last chunk, which keeps chunks from being reordered
+// or the backup from being truncated unnoticed. The header is authenticated
+// with every chunk.
+const (
+	aesMagic          = "BKAE"
+	aesFormatVersion  = 2
+	aesKeyIDLen       = 8
+	aesNoncePrefixLen = 7
+	aesChunkSize      = 64 * 1024
+)
+
+type aesEncryptor struct {
+	key   []byte
+	keyID []byte
+}
+
+func newAESEncryptor(cfg *Config) (Encryptor, error) {
+	key, err := aesKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return aesEncryptor{key: key, keyID: aesKeyID(key)}, nil
+}
+
+// aesKeyID identifies key in the header of the backups encrypted with it, so
+// the right key can be picked when decrypting after keys were rotated. It is
+// derived from the key with a one-way hash, so it reveals nothing about it.
+func aesKeyID(key []byte) []byte {
+	sum := sha256.Sum256(append([]byte("backup-service key id\x00"), key...))
+	return sum[:aesKeyIDLen]
+}
+
+// aesDecryptionKeys returns the keys backups can be decrypted with: the
+// current key and the previous ones from ENCRYPTION_PREVIOUS_KEYS, kept
+// around after a rotation for restoring older backups.
+func aesDecryptionKeys(cfg *Config) ([][]byte, error) {
+	key, err := aesKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := [][]byte{key}
+	for _, value := range splitList(cfg.EncryptionPreviousKeys) {
+		key, err := parseKey("ENCRYPTION_PREVIOUS_KEYS", value)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Metadata records the ID of the key, to find the backups still encrypted
+// with an old key.
+func (e aesEncryptor) Metadata() map[string]string {
+	return map[string]string{"encryption-key-id": fmt.Sprintf("%x", e.keyID)}
+}
+
+// aesKey returns the key from ENCRYPTION_KEY.
+func aesKey(cfg *Config) ([]byte, error) {
+	if strings.TrimSpace(cfg.EncryptionKey) == "" {
+		return nil, fmt.Errorf("ENCRYPTION_KEY or ENCRYPTION_KEY_FILE must be set for aes encryption")
+	}
+
+	return parseKey("ENCRYPTION_KEY", cfg.EncryptionKey)
+}
+
+func (aesEncryptor) Extension() string { return ".enc" }
+
+func (e aesEncryptor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	aead, err := newAESGCM(e.key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(aesMagic)+1+aesKeyIDLen+aesNoncePrefixLen)
+	header = append(header, aesMagic...)
+	header = append(header, aesFormatVersion)
+	header = append(header, e.keyID...)
+	prefix := make([]byte, aesNoncePrefixLen)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  aesNonce(header),
+		buf:    make([]byte, 0, aesChunkSize),
+	}, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// aesNonce returns the nonce of the first chunk, with the prefix from the end
+// of header.
+func aesNonce(header []byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[len(header)-aesNoncePrefixLen:])
+	return nonce
+}
+
+// setAESNonce sets the chunk number and last chunk flag of nonce.
+func setAESNonce(nonce []byte, chunk uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[aesNoncePrefixLen:], chunk)
+	nonce[11] = 0
+	if last {
+		nonce[11] = 1
+	}
+}
+
+type aesWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	chunk  uint32
+	buf    []byte
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, as the last
+		// chunk is sealed differently on Close.
+		if len(a.buf) == aesChunkSize {
+			if err := a.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+
+		take := aesChunkSize - len(a.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		a.buf = append(a.buf, p[:take]...)
+		p = p[take:]
+	}
+
+	return n, nil
+}
+
+func (a *aesWriter) Close() error {
+	return a.seal(true)
+}
+
+func (a *aesWriter) seal(last bool) error {
+	if a.chunk == ^uint32(0) {
+		return errors.New("backup too large to encrypt")
+	}
+
+	setAESNonce(a.nonce, a.chunk, last)
+	if _, err := a.w.Write(a.aead.Seal(nil, a.nonce, a.buf, a.header)); err != nil {
+		return err
+	}
+
+	a.chunk++
+	a.buf = a.buf[:0]
+	return nil
+}
+
+func newAESDecrypter(cfg *Config, r io.Reader) (io.Reader, error) {
+	keys, err := aesDecryptionKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAESReader(r, keys)
+}
+
+// newAESReader returns a reader decrypting a backup encrypted with one of
+// keys. Backups of format version 1 don't name their key, every key is tried
+// on them.
+func newAESReader(r io.Reader, keys [][]byte) (io.Reader, error) {
+	header := make([]byte, len(aesMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if string(header[:len(aesMagic)]) != aesMagic {
+		return nil, errors.New("not an encrypted backup")
+	}
+
+	var keyID []byte
+	switch version := header[len(aesMagic)]; version {
+	case 1:
+	case 2:
+		keyID = make([]byte, aesKeyIDLen)
+		if _, err := io.ReadFull(r, keyID); err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		header = append(header, keyID...)
+	default:
+		return nil, fmt.Errorf("unsupported format version %d", version)
+	}
+
+	prefix := make([]byte, aesNoncePrefixLen)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	header = append(header, prefix...)
+
+	var aeads []cipher.AEAD
+	for _, key := range keys {
+		if keyID != nil && !bytes.Equal(aesKeyID(key), keyID) {
+			continue
+		}
+		aead, err := newAESGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		aeads = append(aeads, aead)
+	}
+	if len(aeads) == 0 {
+		return nil, fmt.Errorf("backup is encrypted with key %x, which is not configured", keyID)
+	}
+
+	return &aesReader{
+		r:      bufio.NewReader(r),
+		aeads:  aeads,
+		header: header,
+		nonce:  aesNonce(header),
+		buf:    make([]byte, aesChunkSize+aeads[0].Overhead()),
+		out:    make([]byte, aesChunkSize),
+	}, nil
+}
+
+type aesReader struct {
+	r *bufio.Reader
+	// aeads holds the candidate keys until the first chunk was decrypted,
+	// and only the matching one from then on.
+	aeads  []cipher.AEAD
+	header []byte
+	nonce  []byte
+	chunk  uint32
+	buf    []byte
+	out    []byte
+	plain  []byte
+	done   bool
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	for len(a.plain) == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		if err := a.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, a.plain)
+	a.plain = a.plain[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk. It is the last one if nothing follows it.
+func (a *aesReader) open() error {
+	n, err := io.ReadFull(a.r, a.buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("encrypted backup is truncated")
+		}
+		return err
+	}
+
+	last := n < len(a.buf)
+	if !last {
+		_, err := a.r.Peek(1)
+		last = err == io.EOF
+	}
+
+	setAESNonce(a.nonce, a.chunk, last)
+	for _, aead := range a.aeads {
+		plain, err := aead.Open(a.out[:0], a.nonce, a.buf[:n], a.header)
+		if err != nil {
+			continue
+		}
+
+		a.aeads = []cipher.AEAD{aead}
+		a.plain = plain
+		a.chunk++
+		a.done = last
+		return nil
+	}
+
+	return errors.New("decryption failed: wrong key, or the backup is corrupt or truncated")
+}
+
+// runDecrypt implements the decrypt command, which decrypts a backup
+// encrypted with ENCRYPTION=aes from stdin to stdout, e.g.
+//
+//	backup-app decrypt < app_backup_20240101_020000.sql.gz.enc | gunzip > app.sql
+func runDecrypt(args []string) {
+	if len(args) != 0 {
+		fatalf("Usage: decrypt < encrypted backup > decrypted backup")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	keys, err := aesDecryptionKeys(cfg)
+	if err != nil {
+		fatalf("Failed to load keys: %v", err)
+	}
+
+	r, err := newAESReader(os.Stdin, keys)
+	if err != nil {
+		fatalf("Failed to decrypt backup: %v", err)
+	}
+	if _, err := io.Copy(os.Stdout, r); err != nil {
+		fatalf("Failed to decrypt backup: %v", err)
+	}
+}
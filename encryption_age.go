@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+func init() {
+	registerEncryptor("age", newAgeEncryptor)
+	registerDecrypter(".age", newAgeDecrypter)
+}
+
+// ageEncryptor encrypts backups to age recipients. Only the public keys are
+// needed for that, so the host running the backups can't decrypt them; the
+// matching identities are kept elsewhere and only used for restores, with
+// AGE_IDENTITY_FILE or the age command line tool:
+//
+//	age -d -i key.txt app_backup_20240101_020000.sql.gz.age | gunzip
+type ageEncryptor struct {
+	recipients []age.Recipient
+}
+
+func newAgeEncryptor(cfg *Config) (Encryptor, error) {
+	// Both variables take the recipients file format of age -R, with one
+	// recipient per line and # comments.
+	list := strings.Join(splitList(cfg.AgeRecipients), "\n")
+	if cfg.AgeRecipientsFile != "" {
+		data, err := os.ReadFile(cfg.AgeRecipientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read AGE_RECIPIENTS_FILE: %w", err)
+		}
+		list += "\n" + string(data)
+	}
+	if strings.TrimSpace(list) == "" {
+		return nil, fmt.Errorf("AGE_RECIPIENTS or AGE_RECIPIENTS_FILE must be set for age encryption")
+	}
+
+	recipients, err := age.ParseRecipients(strings.NewReader(list))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipients: %w", err)
+	}
+
+	return ageEncryptor{recipients: recipients}, nil
+}
+
+func (ageEncryptor) Extension() string { return ".age" }
+
+func (e ageEncryptor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(w, e.recipients...)
+}
+
+// newAgeDecrypter decrypts backups with the identities in AGE_IDENTITY_FILE,
+// in the format of age -i.
+func newAgeDecrypter(cfg *Config, r io.Reader) (io.Reader, error) {
+	if err := checkRequired(map[string]string{"AGE_IDENTITY_FILE": cfg.AgeIdentityFile}); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(cfg.AgeIdentityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AGE_IDENTITY_FILE: %w", err)
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AGE_IDENTITY_FILE: %w", err)
+	}
+
+	return age.Decrypt(r, identities...)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+func init() {
+	registerEncryptor("gpg", newGPGEncryptor)
+	registerDecrypter(".gpg", newGPGDecrypter)
+}
+
+// gpgEncryptor encrypts backups to OpenPGP public keys, for organizations
+// that already manage GPG keys. Backups are regular binary OpenPGP messages,
+// so they are restored with GPG_SECRET_KEY_FILE or the usual tooling:
+//
+//	gpg --decrypt app_backup_20240101_020000.sql.gz.gpg | gunzip
+type gpgEncryptor struct {
+	recipients openpgp.EntityList
+}
+
+func newGPGEncryptor(cfg *Config) (Encryptor, error) {
+	if err := checkRequired(map[string]string{"GPG_RECIPIENTS_FILE": cfg.GPGRecipientsFile}); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(cfg.GPGRecipientsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GPG_RECIPIENTS_FILE: %w", err)
+	}
+
+	recipients, err := readGPGKeyRing(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GPG_RECIPIENTS_FILE: %w", err)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("invalid GPG_RECIPIENTS_FILE: no public keys found")
+	}
+
+	// Expired or revoked keys would only fail the first backup.
+	for _, entity := range recipients {
+		if _, ok := entity.EncryptionKey(time.Now()); !ok {
+			return nil, fmt.Errorf("GPG key %X has no valid encryption key", entity.PrimaryKey.Fingerprint)
+		}
+	}
+
+	return gpgEncryptor{recipients: recipients}, nil
+}
+
+func (gpgEncryptor) Extension() string { return ".gpg" }
+
+func (e gpgEncryptor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	// Backups are compressed already, so OpenPGP's own compression stays off.
+	config := &packet.Config{DefaultCompressionAlgo: packet.CompressionNone}
+
+	return openpgp.Encrypt(w, e.recipients, nil, &openpgp.FileHints{IsBinary: true}, config)
+}
+
+// readGPGKeyRing reads the keys exported with gpg --export --armor, which is
+// the common case, or plain gpg --export keyrings.
+func readGPGKeyRing(data []byte) (openpgp.EntityList, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	return keys, err
+}
+
+// newGPGDecrypter decrypts backups with the secret keys in
+// GPG_SECRET_KEY_FILE, as exported with gpg --export-secret-keys. Keys
+// protected with a passphrase are unlocked with GPG_PASSPHRASE.
+func newGPGDecrypter(cfg *Config, r io.Reader) (io.Reader, error) {
+	if err := checkRequired(map[string]string{"GPG_SECRET_KEY_FILE": cfg.GPGSecretKeyFile}); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(cfg.GPGSecretKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GPG_SECRET_KEY_FILE: %w", err)
+	}
+	keys, err := readGPGKeyRing(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GPG_SECRET_KEY_FILE: %w", err)
+	}
+
+	if cfg.GPGPassphrase != "" {
+		for _, entity := range keys {
+			if err := entity.DecryptPrivateKeys([]byte(cfg.GPGPassphrase)); err != nil {
+				return nil, fmt.Errorf("failed to unlock GPG key %X: %w", entity.PrimaryKey.Fingerprint, err)
+			}
+		}
+	}
+
+	md, err := openpgp.ReadMessage(r, keys, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return md.UnverifiedBody, nil
+}
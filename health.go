@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupHealth tracks the last successful backup of every schedule, for the
+// readiness check of the health server.
+type backupHealth struct {
+	mu      sync.Mutex
+	started time.Time
+	last    map[string]time.Time
+}
+
+var health = &backupHealth{started: time.Now(), last: map[string]time.Time{}}
+
+func healthKey(cfg *Config, tier string) string {
+	return cfg.Block + "/" + tier
+}
+
+// recordSuccess records that a backup of tier in the source block of cfg
+// started at start and succeeded.
+func (h *backupHealth) recordSuccess(cfg *Config, tier string, start time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.last[healthKey(cfg, tier)] = start
+}
+
+// overdue describes the schedules of configs whose backup was due more than
+// HEALTH_GRACE ago without a successful backup since, judged from the last
+// successful backup, or the start of the service if there was none. Paused
+// backups are never overdue.
+func (h *backupHealth) overdue(configs []*Config, now time.Time) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var overdue []string
+	for _, cfg := range configs {
+		if paused(cfg) {
+			continue
+		}
+		for _, schedule := range cfg.Schedules {
+			sched, err := cronParser.Parse(schedule.Spec)
+			if err != nil {
+				continue
+			}
+
+			last, ok := h.last[healthKey(cfg, schedule.Tier)]
+			if !ok {
+				last = h.started
+			}
+			due := sched.Next(last.In(cfg.Location))
+			if now.Sub(due) <= cfg.HealthGrace {
+				continue
+			}
+
+			name := "backup"
+			if schedule.Tier != "" {
+				name = schedule.Tier + " backup"
+			}
+			if cfg.Block != "" {
+				name += " of source block " + cfg.Block
+			}
+			overdue = append(overdue, fmt.Sprintf("%s %q due at %s", name, schedule.Spec, due.Format("2006-01-02 15:04:05")))
+		}
+	}
+
+	return overdue
+}
+
+// startHealthServer serves health checks at HEALTH_ADDR for Docker and
+// Kubernetes, without a token: /healthz answers as long as the process
+// runs, and /readyz with 503 while a scheduled backup is overdue, so backups
+// that fail silently show up as an unhealthy container.
+func startHealthServer(addr string, configs []*Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if overdue := health.overdue(configs, time.Now()); len(overdue) > 0 {
+			http.Error(w, "overdue: "+strings.Join(overdue, "; "), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	go func() {
+		slog.Info("Serving health checks", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fatalf("Health server failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// startHTTPServer serves the backups on the primary destinations over HTTP at
+// HTTP_ADDR, for operators who can reach the service but not the bucket:
+//
+//	curl -H "Authorization: Bearer $HTTP_TOKEN" -O http://backup:8080/backups/backups/app_backup_20240101_020000.sql.gz
+//
+// Backups are streamed through the service as they are stored, split backups
+// put back together. Every request has to carry HTTP_TOKEN. Only the backups
+// of the sources of configs are served, from the primary destination of their
+// source block in destinations, and no other objects in the bucket.
+func startHTTPServer(configs []*Config, destinations []Destination) error {
+	cfg := configs[0]
+	if err := checkRequired(map[string]string{"HTTP_TOKEN": cfg.HTTPToken}); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /backups/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		// PathValue unescapes %2F, so the key can hold any path.
+		key := r.PathValue("key")
+		if path.IsAbs(key) || path.Clean(key) != key || key == ".." || strings.HasPrefix(key, "../") {
+			http.Error(w, "invalid backup key", http.StatusBadRequest)
+			return
+		}
+
+		for i, dest := range destinations {
+			if !isBackupOf(configs[i], dest, key) {
+				continue
+			}
+			body, err := openBackup(r.Context(), dest.Storage, key)
+			if err != nil {
+				continue
+			}
+			defer body.Close()
+
+			slog.Info("Serving backup", "job", "download", "destination", dest.Name, "key", key, "remote", r.RemoteAddr)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(key)))
+			if _, err := io.Copy(w, body); err != nil {
+				slog.Warn("Serving backup failed", "key", key, "remote", r.RemoteAddr, "error", err)
+			}
+			return
+		}
+
+		http.NotFound(w, r)
+	})
+
+	server := &http.Server{Addr: cfg.HTTPAddr, Handler: requireToken(cfg.HTTPToken, mux)}
+	go func() {
+		slog.Info("Serving backups over HTTP", "addr", cfg.HTTPAddr)
+		if err := server.ListenAndServe(); err != nil {
+			fatalf("HTTP server failed: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// isBackupOf reports whether key is a backup of one of the sources of cfg on
+// dest.
+func isBackupOf(cfg *Config, dest Destination, key string) bool {
+	sources, err := newSources(cfg)
+	if err != nil {
+		slog.Warn("Failed to look up backup sources", "job", "download", "destination", dest.Name, "error", err)
+		return false
+	}
+
+	for _, source := range sources {
+		name := source.Name()
+		if strings.HasPrefix(key, listPrefix(dest.KeyPrefix, name)) && strings.HasPrefix(path.Base(key), name+"_backup_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireToken only lets requests through to next that carry token as a
+// bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// Placeholders that can be used in KEY_PREFIX templates. {hostname} and {db}
+// are the same for every backup this service makes, the others depend on the
+// time of the backup.
+var stableKeyPlaceholders = []string{"{hostname}", "{db}"}
+
+// renderKeyPrefix evaluates a key prefix template for a backup of dbName
+// taken at the given time.
+func renderKeyPrefix(template, dbName string, at time.Time) string {
+	return strings.NewReplacer(
+		"{hostname}", hostname(),
+		"{db}", dbName,
+		"{yyyy}", at.Format("2006"),
+		"{mm}", at.Format("01"),
+		"{dd}", at.Format("02"),
+		"{hh}", at.Format("15"),
+	).Replace(template)
+}
+
+// listPrefix returns the part of a key prefix template that is shared by all
+// backups of dbName, i.e. everything up to the first time dependent
+// placeholder. Listing this prefix finds every backup made with the template
+// without touching unrelated objects, such as those of other hosts.
+func listPrefix(template, dbName string) string {
+	prefix := strings.NewReplacer(
+		stableKeyPlaceholders[0], hostname(),
+		stableKeyPlaceholders[1], dbName,
+	).Replace(template)
+
+	if i := strings.Index(prefix, "{"); i >= 0 {
+		prefix = prefix[:i]
+	}
+
+	return prefix
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+
+	return name
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// splitPartRe matches the parts of split backups, which are listed as one
+// backup under the name of their manifest.
+var splitPartRe = regexp.MustCompile(`\.part[0-9]{4}$`)
+
+// backupInfo describes a backup stored on a destination.
+type backupInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Parts        int       `json:"parts,omitempty"`
+	Protected    bool      `json:"protected,omitempty"`
+}
+
+// runList implements the list command, which prints the backups of every
+// source on the primary destination, newest first, as a table or as JSON:
+//
+//	backup-app list --json
+func runList(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the backups as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fatalf("Usage: list [--json]")
+	}
+
+	configs, err := loadRestoreConfigs()
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	ctx := context.Background()
+	backups := []backupInfo{}
+	for _, cfg := range configs {
+		destinations, err := newDestinations(cfg)
+		if err != nil {
+			fatalf("Failed to create storage backend: %v", err)
+		}
+		sources, err := newSources(cfg)
+		if err != nil {
+			fatalf("Failed to create backup source: %v", err)
+		}
+
+		for _, source := range sources {
+			list, err := listBackups(ctx, destinations[0], source.Name())
+			if err != nil {
+				fatalf("Failed to list backups of %s: %v", source.Name(), err)
+			}
+			backups = append(backups, list...)
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].LastModified.After(backups[j].LastModified)
+	})
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(backups); err != nil {
+			fatalf("Failed to print backups: %v", err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSIZE\tLAST MODIFIED\tSHA256")
+	for _, backup := range backups {
+		sum := backup.SHA256
+		if sum == "" {
+			sum = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", backup.Key, formatSize(backup.Size), backup.LastModified.Local().Format("2006-01-02 15:04:05"), sum)
+	}
+	w.Flush()
+}
+
+// listBackups returns the backups of dbName on dest, newest first, as
+// listed in the catalog of dbName, or as stored on dest if it has no
+// catalog.
+func listBackups(ctx context.Context, dest Destination, dbName string) ([]backupInfo, error) {
+	catalog, err := readCatalog(ctx, dest, dbName)
+	if err != nil {
+		return listStoredBackups(ctx, dest, dbName)
+	}
+
+	backups := make([]backupInfo, 0, len(catalog.Backups))
+	for _, entry := range catalog.Backups {
+		backups = append(backups, backupInfo{Key: entry.Key, Size: entry.Size, LastModified: entry.Timestamp, SHA256: entry.SHA256, Parts: entry.Parts, Protected: entry.Protected})
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].LastModified.After(backups[j].LastModified)
+	})
+
+	return backups, nil
+}
+
+// listStoredBackups returns the backups of dbName stored on dest, newest
+// first. Split backups are listed once their manifest was uploaded, under
+// the key they were split from, with the size of all parts. Checksums are
+// read from the manifests of split backups and from the sha256 metadata of
+// the others, where the backend can return it.
+func listStoredBackups(ctx context.Context, dest Destination, dbName string) ([]backupInfo, error) {
+	objects, err := dest.Storage.List(ctx, listPrefix(dest.KeyPrefix, dbName))
+	if err != nil {
+		return nil, err
+	}
+
+	partSizes := map[string]int64{}
+	for _, obj := range objects {
+		if splitPartRe.MatchString(obj.Key) {
+			partSizes[splitPartRe.ReplaceAllString(obj.Key, "")] += obj.Size
+		}
+	}
+
+	var backups []backupInfo
+	for _, obj := range objects {
+		if !strings.HasPrefix(path.Base(obj.Key), dbName+"_backup_") || splitPartRe.MatchString(obj.Key) || dest.Retention.archived(obj.Key) {
+			continue
+		}
+
+		backup := backupInfo{Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified}
+		if key, ok := strings.CutSuffix(obj.Key, ".manifest.json"); ok {
+			manifest, err := readManifest(ctx, dest.Storage, key)
+			if err != nil {
+				slog.Warn("Skipping split backup", "source", dbName, "destination", dest.Name, "key", key, "error", err)
+				continue
+			}
+			backup.Key, backup.Size, backup.SHA256, backup.Parts = key, partSizes[key], manifest.SHA256, len(manifest.Parts)
+		} else if reader, ok := dest.Storage.(MetadataReader); ok {
+			if metadata, err := reader.Metadata(ctx, obj.Key); err == nil {
+				backup.SHA256 = metadata["sha256"]
+			}
+		}
+		backups = append(backups, backup)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].LastModified.After(backups[j].LastModified)
+	})
+
+	return backups, nil
+}
+
+// formatSize formats size in bytes with a binary unit, like 1.5 GiB.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// localDestination returns BACKUP_DIR as a destination, to restore the
+// backups kept there with KEEP_LOCAL_BACKUPS or LOCAL_RETENTION_DAYS.
+func localDestination(cfg *Config) Destination {
+	return Destination{Name: cfg.BackupDir, Storage: &localBackend{dir: cfg.BackupDir}}
+}
+
+// localBackups returns the backups of dbName kept in BACKUP_DIR, newest
+// first, under their file names.
+func localBackups(cfg *Config, dbName string) ([]backupInfo, error) {
+	entries, err := os.ReadDir(cfg.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), dbName+"_backup_") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupInfo{Key: entry.Name(), Size: info.Size(), LastModified: info.ModTime()})
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].LastModified.After(backups[j].LastModified)
+	})
+
+	return backups, nil
+}
+
+// keepLocalBackups reports whether backups are kept in BACKUP_DIR after
+// they were uploaded.
+func keepLocalBackups(cfg *Config) bool {
+	return cfg.KeepLocalBackups > 0 || cfg.LocalRetentionDays > 0
+}
+
+// pruneLocalBackups deletes the backups of dbName in BACKUP_DIR beyond the
+// KEEP_LOCAL_BACKUPS most recent ones and those older than
+// LOCAL_RETENTION_DAYS, independently of the retention on the destinations.
+func pruneLocalBackups(cfg *Config, dbName string) {
+	backups, err := localBackups(cfg, dbName)
+	if err != nil {
+		slog.Warn("Local cleanup failed", "dir", cfg.BackupDir, "error", err)
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -cfg.LocalRetentionDays)
+	for i, backup := range backups {
+		if (cfg.KeepLocalBackups == 0 || i < cfg.KeepLocalBackups) && (cfg.LocalRetentionDays == 0 || !backup.LastModified.Before(cutoff)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cfg.BackupDir, backup.Key)); err != nil {
+			slog.Warn("Local cleanup failed", "dir", cfg.BackupDir, "error", err)
+		}
+	}
+}
+
+// restoreSource returns where to restore the backup at key on dest from.
+// That is dest, unless the backup can't be downloaded from it and a copy
+// with the same name is still kept in BACKUP_DIR, which is restored instead.
+func restoreSource(ctx context.Context, cfg *Config, dest Destination, key string) (Destination, string) {
+	body, err := openBackup(ctx, dest.Storage, key)
+	if err == nil {
+		body.Close()
+		return dest, key
+	}
+
+	name := path.Base(key)
+	if _, serr := os.Stat(filepath.Join(cfg.BackupDir, name)); serr != nil {
+		return dest, key
+	}
+
+	slog.Warn("Download failed, restoring the local copy instead", "key", key, "destination", dest.Name, "dir", cfg.BackupDir, "error", err)
+	return localDestination(cfg), name
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// setupLogging configures the output of the service from LOG_FORMAT,
+// LOG_LEVEL and LOG_FILE, before the configuration is loaded, so every
+// command logs alike. The default, text, keeps the classic log lines, with
+// the level and the fields of structured messages, like source and key,
+// appended. With json, every line is a JSON object for Loki, Elasticsearch
+// and the like. Messages of the log package are logged at the info level.
+func setupLogging() error {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q (expected debug, info, warn or error)", value)
+		}
+	}
+
+	var w io.Writer = os.Stderr
+	if path := os.Getenv("LOG_FILE"); path != "" {
+		maxSize := int64(10 << 20)
+		if value := os.Getenv("LOG_MAX_SIZE"); value != "" {
+			size, err := parseSize(value)
+			if err != nil {
+				return fmt.Errorf("invalid LOG_MAX_SIZE: %w", err)
+			}
+			maxSize = size
+		}
+		maxFiles := 5
+		if value := os.Getenv("LOG_MAX_FILES"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid LOG_MAX_FILES %q (expected a number of files)", value)
+			}
+			maxFiles = n
+		}
+
+		file, err := openRotatingFile(path, maxSize, maxFiles)
+		if err != nil {
+			return err
+		}
+		w = io.MultiWriter(os.Stderr, file)
+	}
+
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "text":
+		slog.SetDefault(slog.New(&classicHandler{w: w, level: level, mu: &sync.Mutex{}}))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q (expected text or json)", format)
+	}
+
+	return nil
+}
+
+// classicHandler writes records as the log package does, the time followed
+// by the level, the message and the attributes as key=value.
+type classicHandler struct {
+	w     io.Writer
+	level slog.Level
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *classicHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *classicHandler) Handle(ctx context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	b.WriteString(r.Level.String())
+	b.WriteString(" ")
+	b.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		value := a.Value.Resolve().String()
+		if strings.ContainsAny(value, " =\"") || value == "" {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", a.Key, value)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *classicHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &classicHandler{w: h.w, level: h.level, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...), mu: h.mu}
+}
+
+// WithGroup is not used by the service, so groups are flattened.
+func (h *classicHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// rotatingFile is a log file that is rotated once it reaches maxSize: it is
+// renamed to <path>.1, older files to <path>.2 and so on, keeping maxFiles
+// of them.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxFiles > 0 {
+		os.Rename(f.path, f.path+".1")
+	} else {
+		os.Remove(f.path)
+	}
+
+	return f.open()
+}
+
+// fatalf logs a message at the error level, so it shows whatever LOG_LEVEL
+// is, and exits with status 1, like log.Fatalf.
+func fatalf(format string, args ...any) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
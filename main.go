@@ -1,309 +1,653 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-type Config struct {
-	R2AccessKeyID     string
-	R2SecretAccessKey string
-	R2AccountID       string
-	R2Bucket          string
-	DBPath            string
-	HostDBPath        string
-	BackupDir         string
-	RetentionDays     int
-}
+const uploadRetryDelay = 10 * time.Second
 
-func loadConfig() (*Config, error) {
-	cfg := &Config{
-		R2AccessKeyID:     os.Getenv("R2_ACCESS_KEY_ID"),
-		R2SecretAccessKey: os.Getenv("R2_SECRET_ACCESS_KEY"),
-		R2AccountID:       os.Getenv("R2_ACCOUNT_ID"),
-		R2Bucket:          os.Getenv("R2_BUCKET"),
-		DBPath:            os.Getenv("DB_PATH"),
-		HostDBPath:        os.Getenv("HOST_DB_PATH"),
-		BackupDir:         os.Getenv("BACKUP_DIR"),
-		RetentionDays:     30, // default value
+// createBackup dumps source into a file at backupPath, compressed with comp
+// and then encrypted with enc.
+func createBackup(ctx context.Context, source Source, comp Compressor, enc Encryptor, backupPath string) error {
+	// Create backup directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
 	}
 
-	if cfg.BackupDir == "" {
-		cfg.BackupDir = "/backups"
+	dst, err := os.Create(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to create compressed file: %w", err)
 	}
+	defer dst.Close()
 
-	if retentionDays := os.Getenv("RETENTION_DAYS"); retentionDays != "" {
-		_, err := fmt.Sscanf(retentionDays, "%d", &cfg.RetentionDays)
-		if err != nil {
-			return nil, fmt.Errorf("invalid RETENTION_DAYS: %w", err)
-		}
+	ew, err := enc.NewWriter(dst)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt file: %w", err)
+	}
+	cw, err := comp.NewWriter(ew)
+	if err != nil {
+		return fmt.Errorf("failed to compress file: %w", err)
+	}
+	if err := source.Dump(ctx, cw); err != nil {
+		return err
+	}
+
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("failed to compress file: %w", err)
+	}
+	if err := ew.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt file: %w", err)
+	}
+
+	return dst.Close()
+}
+
+func uploadBackup(ctx context.Context, storage StorageBackend, key, filePath string, metadata map[string]string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file for upload: %w", err)
 	}
+	defer file.Close()
 
-	// Validate required fields
-	required := map[string]string{
-		"R2_ACCESS_KEY_ID":     cfg.R2AccessKeyID,
-		"R2_SECRET_ACCESS_KEY": cfg.R2SecretAccessKey,
-		"R2_ACCOUNT_ID":        cfg.R2AccountID,
-		"R2_BUCKET":            cfg.R2Bucket,
-		"DB_PATH":              cfg.DBPath,
-		"HOST_DB_PATH":         cfg.HostDBPath,
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file for upload: %w", err)
 	}
 
-	for name, value := range required {
-		if value == "" {
-			return nil, fmt.Errorf("required environment variable %s is not set", name)
+	return storage.Put(ctx, key, file, info.Size(), metadata)
+}
+
+// replicateBackup copies a backup that was uploaded to source into replica,
+// server-side where the backend supports it and by uploading the local file
+// otherwise.
+func replicateBackup(ctx context.Context, cfg *Config, source, replica Destination, key, filePath string, metadata map[string]string) error {
+	// Split backups are simply uploaded again, part by part.
+	if split, _ := needsSplit(cfg, filePath); split {
+		return uploadSplit(ctx, cfg, replica, key, filePath, metadata)
+	}
+
+	if copier, ok := replica.Storage.(ServerSideCopier); ok {
+		err := copier.CopyFrom(ctx, source.Storage, key)
+		if err == nil {
+			return nil
 		}
+		slog.Warn("Server-side copy failed, uploading instead", "destination", replica.Name, "key", key, "error", err)
 	}
 
-	return cfg, nil
+	return uploadWithRetry(ctx, cfg, replica, key, filePath, metadata)
 }
 
-func createS3Client(cfg *Config) (*s3.Client, error) {
-	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			URL: fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cfg.R2AccountID),
-		}, nil
+// uploadWithRetry uploads filePath to dest, retrying failed uploads with an
+// exponential backoff.
+func uploadWithRetry(ctx context.Context, cfg *Config, dest Destination, key, filePath string, metadata map[string]string) error {
+	return withRetry(cfg, dest, func() error {
+		return uploadBackup(ctx, dest.Storage, key, filePath, metadata)
 	})
+}
 
-	awsCfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithEndpointResolverWithOptions(r2Resolver),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			cfg.R2AccessKeyID,
-			cfg.R2SecretAccessKey,
-			"",
-		)),
-		config.WithRegion("auto"),
-	)
+// withRetry runs upload, retrying it UPLOAD_RETRIES times with an exponential
+// backoff if it fails.
+func withRetry(cfg *Config, dest Destination, upload func() error) error {
+	delay := uploadRetryDelay
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = upload(); err == nil || attempt >= cfg.UploadRetries {
+			return err
+		}
+
+		slog.Warn("Upload failed, retrying", "destination", dest.Name, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// cleanupOldBackups deletes the backups of dbName on dest that its retention
+// policy doesn't keep, with all of their parts if they were split, and
+// returns their keys. Backups protected in the catalog, and other objects
+// under the prefix, such as the backups of other sources sharing it, are left
+// alone. With RETENTION_ARCHIVE_DAYS, the backups are archived instead, and
+// deleted from the archive once its grace period is over. In a dry run, the
+// backups are only logged.
+func cleanupOldBackups(ctx context.Context, dest Destination, dbName string) (deleted []string, err error) {
+	ctx, span := startSpan(ctx, "prune", attribute.String("source", dbName), attribute.String("destination", dest.Name))
+	defer func() {
+		span.SetAttributes(attribute.Int("deleted", len(deleted)))
+		endSpan(span, err)
+	}()
+
+	objects, err := dest.Storage.List(ctx, listPrefix(dest.KeyPrefix, dbName))
 	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config: %w", err)
+		return nil, err
 	}
+	// Without the catalog, it isn't known which backups are protected.
+	protected, err := protectedBackups(ctx, dest, dbName)
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.With("job", "prune", "source", dbName, "destination", dest.Name)
 
-	return s3.NewFromConfig(awsCfg), nil
-}
+	// With an empty key prefix, the archive is listed as well.
+	var live []BackupObject
+	for _, obj := range objects {
+		if !dest.Retention.archived(obj.Key) {
+			live = append(live, obj)
+		}
+	}
 
-func createBackup(dbPath, backupPath string) error {
-	// Create backup directory if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
-		return fmt.Errorf("failed to create backup directory: %w", err)
+	backups := storedBackups(live, dbName)
+	logger.Debug("Applying retention", "backups", len(backups), "protected", len(protected))
+
+	for _, backup := range dest.Retention.expired(backups, time.Now(), logger) {
+		if protected[backup.Key] {
+			logger.Info("Keeping protected backup", "key", backup.Key, "reason", backup.Reason)
+			continue
+		}
+		if dest.Retention.DryRun {
+			action := "delete"
+			if dest.Retention.ArchiveDays > 0 {
+				action = "archive"
+			}
+			for _, obj := range backup.Objects {
+				logger.Info("Retention dry run: would "+action+" backup", "key", obj.Key, "bytes", obj.Size, "time", backup.Time, "reason", backup.Reason)
+			}
+			continue
+		}
+		if dest.Retention.ArchiveDays > 0 {
+			if err := archiveBackup(ctx, dest, backup.storedBackup); err != nil {
+				logger.Error("Failed to archive old backup", "key", backup.Key, "error", err)
+				continue
+			}
+			logger.Info("Archived old backup", "key", backup.Key, "archive", dest.Retention.ArchivePrefix+backup.Key, "reason", backup.Reason)
+			deleted = append(deleted, backup.Key)
+			continue
+		}
+
+		ok := true
+		for _, obj := range backup.Objects {
+			if err := dest.Storage.Delete(ctx, obj.Key); err != nil {
+				logger.Error("Failed to delete old backup", "key", obj.Key, "error", err)
+				ok = false
+			} else {
+				logger.Info("Deleted old backup", "key", obj.Key, "bytes", obj.Size, "reason", backup.Reason)
+			}
+		}
+		if ok {
+			deleted = append(deleted, backup.Key)
+		}
 	}
 
-	// Copy the database file
-	src, err := os.Open(dbPath)
-	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
+	if dest.Retention.ArchiveDays > 0 {
+		if err := pruneArchive(ctx, dest, dbName); err != nil {
+			return deleted, err
+		}
 	}
-	defer src.Close()
 
-	dst, err := os.Create(backupPath)
-	if err != nil {
-		return fmt.Errorf("failed to create backup file: %w", err)
+	return deleted, nil
+}
+
+func scheduleBackup(cfg *Config, destinations []Destination) error {
+	c := cron.New(cron.WithParser(cronParser), cron.WithLocation(cfg.Location))
+
+	for _, schedule := range cfg.Schedules {
+		tier := schedule.Tier
+		if cfg.Block != "" {
+			slog.Info("Scheduling backups", "block", cfg.Block, "schedule", schedule.Spec, "tier", tier, "timezone", cfg.Location.String())
+		} else {
+			slog.Info("Scheduling backups", "schedule", schedule.Spec, "tier", tier, "timezone", cfg.Location.String())
+		}
+		_, err := c.AddFunc(schedule.Spec, func() {
+			if tier != "" {
+				slog.Info("Starting scheduled backup", "job", "backup", "tier", tier)
+			} else {
+				slog.Info("Starting scheduled backup", "job", "backup")
+			}
+			runAndRecord(cfg, destinations, tier)
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to schedule backup: %w", err)
+		}
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
-		return fmt.Errorf("failed to copy database: %w", err)
+	if cfg.VerifySchedule != "" {
+		restoreCfg, err := restoreConfig(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to load restore configuration: %w", err)
+		}
+		restoreDestinations, err := newDestinations(restoreCfg)
+		if err != nil {
+			return fmt.Errorf("failed to create restore storage backend: %w", err)
+		}
+
+		slog.Info("Scheduling restore checks", "job", "verify", "schedule", cfg.VerifySchedule, "timezone", cfg.Location.String())
+		if _, err := c.AddFunc(cfg.VerifySchedule, func() { checkRestores(restoreCfg, restoreDestinations) }); err != nil {
+			return fmt.Errorf("failed to schedule restore checks: %w", err)
+		}
 	}
 
+	c.Start()
 	return nil
 }
 
-func compressFile(srcPath, dstPath string) error {
-	src, err := os.Open(srcPath)
-	if err != nil {
-		return fmt.Errorf("failed to open source file: %w", err)
+// runLocks holds a lock for every source block, so that backups started by
+// the schedule, a catch-up, a change or SIGUSR1 never run at the same time
+// and race each other updating the catalog or applying retention.
+var (
+	runLocksMu sync.Mutex
+	runLocks   = map[string]*sync.Mutex{}
+)
+
+func runLock(cfg *Config) *sync.Mutex {
+	runLocksMu.Lock()
+	defer runLocksMu.Unlock()
+
+	lock, ok := runLocks[cfg.Block]
+	if !ok {
+		lock = &sync.Mutex{}
+		runLocks[cfg.Block] = lock
 	}
-	defer src.Close()
 
-	dst, err := os.Create(dstPath)
+	return lock
+}
+
+// runBackup backs up every source, one after the other. A failed source
+// doesn't keep the others from being backed up. tier is the schedule tier
+// the run belongs to, if any. It reports whether every source was backed up.
+// A run started while another one of the source block is still running is
+// skipped, as that one already backs up every source, and counts as failed.
+func runBackup(cfg *Config, destinations []Destination, tier string) bool {
+	lock := runLock(cfg)
+	if !lock.TryLock() {
+		slog.Warn("Backup skipped: a backup is already running", "job", "backup", "block", cfg.Block, "tier", tier)
+		return false
+	}
+	defer lock.Unlock()
+
+	ctx := context.Background()
+	start := time.Now()
+
+	sources, err := newSources(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to create compressed file: %w", err)
+		slog.Error("Backup failed", "job", "backup", "error", err)
+		return false
 	}
-	defer dst.Close()
+	if len(sources) == 0 {
+		slog.Info("Backup skipped: nothing to back up", "job", "backup")
+		return true
+	}
+	sources = bundleSources(cfg, sources)
 
-	gw := gzip.NewWriter(dst)
-	defer gw.Close()
+	ctx, span := startSpan(ctx, "backup run", attribute.String("tier", tier))
+	defer span.End()
 
-	if _, err := io.Copy(gw, src); err != nil {
-		return fmt.Errorf("failed to compress file: %w", err)
+	snapshotCtx, snapshotSpan := startSpan(ctx, "snapshot")
+	snapshotVolumes(snapshotCtx, cfg)
+	snapshotSpan.End()
+
+	var failed []string
+	for _, source := range sources {
+		if !backupSource(ctx, cfg, source, destinations, tier) {
+			failed = append(failed, source.Name())
+		}
 	}
 
-	return nil
+	if len(sources) > 1 {
+		if len(failed) > 0 {
+			slog.Warn("Backup run finished with failed sources", "job", "backup", "sources", len(sources), "failed", strings.Join(failed, ", "), "duration", time.Since(start))
+		} else {
+			slog.Info("Backup run finished: all sources backed up", "job", "backup", "sources", len(sources), "duration", time.Since(start))
+		}
+	}
+
+	return len(failed) == 0
 }
 
-func uploadToR2(client *s3.Client, cfg *Config, filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open file for upload: %w", err)
-	}
-	defer file.Close()
+// backupSource dumps, compresses and uploads a source to every destination,
+// then prunes its old backups from each of them. The backup only counts as
+// failed, and false is returned, when the upload to the primary destination
+// fails and there is no failover destination to fall back to. A backup that
+// had to use the failover destination is reported as degraded. Backups of a
+// tier are named <name>_backup_<tier>_<timestamp>.
+func backupSource(ctx context.Context, cfg *Config, source Source, destinations []Destination, tier string) (ok bool) {
+	dbName := source.Name()
+	now := time.Now()
+	logger := slog.With("job", "backup", "source", dbName)
+
+	ctx, span := startSpan(ctx, "backup", attribute.String("source", dbName), attribute.String("tier", tier))
+	defer func() {
+		var err error
+		if !ok {
+			err = fmt.Errorf("backup of %s failed", dbName)
+		}
+		endSpan(span, err)
+	}()
 
-	key := fmt.Sprintf("backups/%s", filepath.Base(filePath))
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(cfg.R2Bucket),
-		Key:    aws.String(key),
-		Body:   file,
-	})
+	timestamp := now.Format("20060102_150405")
+	if tier != "" {
+		timestamp = tier + "_" + timestamp
+	}
 
+	comp, err := newCompressor(cfg)
+	if err != nil {
+		logger.Error("Backup failed", "error", err)
+		return false
+	}
+	enc, err := newEncryptor(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to upload to R2: %w", err)
+		logger.Error("Backup failed", "error", err)
+		return false
 	}
+	compressedFile := filepath.Join(cfg.BackupDir, fmt.Sprintf("%s_backup_%s%s%s%s", dbName, timestamp, source.Extension(), comp.Extension(), enc.Extension()))
 
-	return nil
-}
+	logger.Debug("Starting backup", "file", compressedFile, "compression", cfg.Compression, "encryption", cfg.Encryption)
+	// The source is dumped, compressed and encrypted in a single stream.
+	dumpCtx, dumpSpan := startSpan(ctx, "dump", attribute.String("compression", cfg.Compression), attribute.String("encryption", cfg.Encryption))
+	err = createBackup(dumpCtx, source, comp, enc, compressedFile)
+	endSpan(dumpSpan, err)
+	if err != nil {
+		os.Remove(compressedFile)
+		logger.Error("Backup failed", "error", err)
+		return false
+	}
 
-func cleanupOldBackups(client *s3.Client, cfg *Config) error {
-	cutoff := time.Now().AddDate(0, 0, -cfg.RetentionDays)
+	// Clean up local files, unless the most recent ones are kept to restore
+	// from when the destinations can't be reached.
+	if keepLocalBackups(cfg) {
+		defer pruneLocalBackups(cfg, dbName)
+	} else {
+		defer os.Remove(compressedFile)
+	}
 
-	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(cfg.R2Bucket),
-		Prefix: aws.String("backups/"),
+	metadata, err := backupMetadata(cfg, source, enc, compressedFile)
+	if err != nil {
+		logger.Error("Backup failed", "error", err)
+		return false
+	}
+	if tier != "" {
+		metadata["tier"] = tier
 	}
 
-	result, err := client.ListObjectsV2(context.TODO(), input)
+	info, err := os.Stat(compressedFile)
 	if err != nil {
-		return fmt.Errorf("failed to list R2 objects: %w", err)
+		logger.Error("Backup failed", "error", err)
+		return false
+	}
+	logger.Info("Created backup", "file", compressedFile, "bytes", info.Size(), "duration", time.Since(now))
+	entry := catalogEntry{
+		Source:          dbName,
+		Timestamp:       now,
+		Size:            info.Size(),
+		SHA256:          metadata["sha256"],
+		Encryption:      metadata["encryption"],
+		EncryptionKeyID: metadata["encryption-key-id"],
+		Tier:            tier,
+	}
+	if split, _ := needsSplit(cfg, compressedFile); split {
+		entry.Parts = int((info.Size() + cfg.SplitSize - 1) / cfg.SplitSize)
+	}
+	recordBackup := func(dest Destination, key string, deleted []string) {
+		entry.Key = key
+		if err := updateCatalog(ctx, dest, entry, deleted); err != nil {
+			logger.Warn("Catalog update failed", "destination", dest.Name, "error", err)
+		}
+		if err := updateLatest(ctx, dest, entry); err != nil {
+			logger.Warn("Latest pointer update failed", "destination", dest.Name, "error", err)
+		}
 	}
 
-	for _, obj := range result.Contents {
-		if obj.LastModified.Before(cutoff) {
-			_, err := client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-				Bucket: aws.String(cfg.R2Bucket),
-				Key:    obj.Key,
-			})
-			if err != nil {
-				log.Printf("Failed to delete old backup %s: %v", *obj.Key, err)
-			} else {
-				log.Printf("Deleted old backup: %s", *obj.Key)
-			}
+	var failed []string
+	primaryFailed := false
+	var failover *Destination
+	var replicas []Destination
+	for i, dest := range destinations {
+		if dest.Failover {
+			failover = &destinations[i]
+			continue
+		}
+		if dest.Replica {
+			replicas = append(replicas, dest)
+			continue
 		}
+
+		key := renderKeyPrefix(dest.KeyPrefix, dbName, now) + filepath.Base(compressedFile)
+		start := time.Now()
+		if err := tracedUpload(ctx, "upload", dest, key, info.Size(), func(ctx context.Context) error {
+			return storeBackup(ctx, cfg, dest, key, compressedFile, metadata)
+		}); err != nil {
+			logger.Error("Upload failed", "destination", dest.Name, "key", key, "error", err)
+			failed = append(failed, dest.Name)
+			primaryFailed = primaryFailed || i == 0
+			continue
+		}
+		logger.Info("Uploaded backup", "destination", dest.Name, "key", key, "bytes", info.Size(), "duration", time.Since(start))
+
+		deleted, err := cleanupOldBackups(ctx, dest, dbName)
+		if err != nil {
+			logger.Warn("Cleanup failed", "destination", dest.Name, "error", err)
+		}
+		recordBackup(dest, key, deleted)
 	}
 
-	return nil
-}
+	degraded := false
+	if primaryFailed {
+		if failover == nil {
+			logger.Error("Backup failed: upload to primary destination failed", "destination", destinations[0].Name)
+			return false
+		}
 
-func scheduleBackup(cfg *Config, s3Client *s3.Client) error {
-    c := cron.New(cron.WithLocation(time.Local))
-
-    // Schedule backup for 2 AM every day
-    _, err := c.AddFunc("0 2 * * *", func() {
-        log.Printf("Starting scheduled backup at %v", time.Now().Format("2006-01-02 15:04:05"))
-        
-        // Extract database name from HOST_DB_PATH
-        dbName := filepath.Base(cfg.HostDBPath)
-        // Remove the extension if present
-        dbName = strings.TrimSuffix(dbName, filepath.Ext(dbName))
-        
-        timestamp := time.Now().Format("20060102_150405")
-        backupFile := filepath.Join(cfg.BackupDir, fmt.Sprintf("%s_backup_%s.sql", dbName, timestamp))
-        compressedFile := backupFile + ".gz"
-
-        if err := createBackup(cfg.DBPath, backupFile); err != nil {
-            log.Printf("Backup failed: %v", err)
-            return
-        }
-
-        if err := compressFile(backupFile, compressedFile); err != nil {
-            log.Printf("Compression failed: %v", err)
-            return
-        }
-
-        if err := uploadToR2(s3Client, cfg, compressedFile); err != nil {
-            log.Printf("Upload failed: %v", err)
-            return
-        }
-
-        if err := cleanupOldBackups(s3Client, cfg); err != nil {
-            log.Printf("Cleanup warning: %v", err)
-        }
-
-        // Clean up local files
-        os.Remove(backupFile)
-        os.Remove(compressedFile)
-
-        log.Println("Scheduled backup completed successfully")
-    })
-
-    if err != nil {
-        return fmt.Errorf("failed to schedule backup: %w", err)
-    }
-
-    c.Start()
-    return nil
-}
+		logger.Warn("Primary destination failed, falling back to failover destination", "destination", destinations[0].Name, "failover", failover.Name)
+		key := renderKeyPrefix(failover.KeyPrefix, dbName, now) + filepath.Base(compressedFile)
+		start := time.Now()
+		if err := tracedUpload(ctx, "upload", *failover, key, info.Size(), func(ctx context.Context) error {
+			return storeBackup(ctx, cfg, *failover, key, compressedFile, metadata)
+		}); err != nil {
+			logger.Error("Backup failed: upload to failover destination failed", "destination", failover.Name, "key", key, "error", err)
+			return false
+		}
+		logger.Info("Uploaded backup", "destination", failover.Name, "key", key, "bytes", info.Size(), "duration", time.Since(start))
 
-// New helper function to run a backup
-func runBackup(cfg *Config, s3Client *s3.Client) {
-	 // Extract database name from HOST_DB_PATH
-	 dbName := filepath.Base(cfg.HostDBPath)
-	 // Remove the extension if present
-	 dbName = strings.TrimSuffix(dbName, filepath.Ext(dbName))
+		deleted, err := cleanupOldBackups(ctx, *failover, dbName)
+		if err != nil {
+			logger.Warn("Cleanup failed", "destination", failover.Name, "error", err)
+		}
+		recordBackup(*failover, key, deleted)
+		degraded = true
+	}
 
-	 timestamp := time.Now().Format("20060102_150405")
-	 backupFile := filepath.Join(cfg.BackupDir, fmt.Sprintf("%s_backup_%s.sql", dbName, timestamp))
-	 compressedFile := backupFile + ".gz"
+	// Replicas copy from the primary, so they are skipped in degraded runs.
+	if !primaryFailed {
+		for _, replica := range replicas {
+			key := renderKeyPrefix(replica.KeyPrefix, dbName, now) + filepath.Base(compressedFile)
+			start := time.Now()
+			if err := tracedUpload(ctx, "replicate", replica, key, info.Size(), func(ctx context.Context) error {
+				return replicateBackup(ctx, cfg, destinations[0], replica, key, compressedFile, metadata)
+			}); err != nil {
+				logger.Error("Replication failed", "destination", replica.Name, "key", key, "error", err)
+				failed = append(failed, replica.Name)
+				continue
+			}
+			logger.Info("Replicated backup", "destination", replica.Name, "key", key, "bytes", info.Size(), "duration", time.Since(start))
+
+			deleted, err := cleanupOldBackups(ctx, replica, dbName)
+			if err != nil {
+				logger.Warn("Cleanup failed", "destination", replica.Name, "error", err)
+			}
+			recordBackup(replica, key, deleted)
+		}
+	}
 
-	if err := createBackup(cfg.DBPath, backupFile); err != nil {
-		log.Printf("Backup failed: %v", err)
-		return
+	if degraded {
+		logger.Warn("Backup completed in DEGRADED mode: stored on failover destination because upload failed", "failover", failover.Name, "failed", strings.Join(failed, ", "), "duration", time.Since(now))
+		return true
 	}
 
-	if err := compressFile(backupFile, compressedFile); err != nil {
-		log.Printf("Compression failed: %v", err)
-		return
+	if len(failed) > 0 {
+		logger.Warn("Backup completed, but upload failed", "failed", strings.Join(failed, ", "), "duration", time.Since(now))
+		return true
 	}
 
-	if err := uploadToR2(s3Client, cfg, compressedFile); err != nil {
-		log.Printf("Upload failed: %v", err)
-		return
+	logger.Info("Backup completed successfully", "duration", time.Since(now))
+	return true
+}
+
+// setup checks that the sources, compression and encryption of cfg are
+// configured correctly and creates its destinations.
+func setup(cfg *Config) ([]Destination, error) {
+	// Sources are created again for every run, this only checks that they
+	// are configured correctly.
+	if _, err := newSources(cfg); err != nil {
+		return nil, fmt.Errorf("failed to create backup source: %w", err)
+	}
+	if _, err := newCompressor(cfg); err != nil {
+		return nil, fmt.Errorf("failed to configure compression: %w", err)
+	}
+	if _, err := newEncryptor(cfg); err != nil {
+		return nil, fmt.Errorf("failed to configure encryption: %w", err)
 	}
 
-	if err := cleanupOldBackups(s3Client, cfg); err != nil {
-		log.Printf("Cleanup warning: %v", err)
+	destinations, err := newDestinations(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage backend: %w", err)
 	}
 
-	// Clean up local files
-	os.Remove(backupFile)
-	os.Remove(compressedFile)
+	if cfg.BucketLifecycle {
+		if err := configureLifecycle(context.Background(), cfg, destinations); err != nil {
+			slog.Warn("Failed to configure bucket lifecycle", "error", err)
+		}
+	}
 
-	log.Println("Backup completed successfully")
+	return destinations, nil
 }
 
 func main() {
-	log.Printf("Starting backup service in timezone: %s", time.Local.String())
-	
-	cfg, err := loadConfig()
+	if err := setupLogging(); err != nil {
+		fatalf("Failed to configure logging: %v", err)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		fatalf("Failed to configure tracing: %v", err)
+	}
+	// Spans are exported in batches, so the last ones are flushed before a
+	// command exits.
+	defer shutdownTracing(context.Background())
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "archive-wal":
+			runArchiveWAL(os.Args[2:])
+			return
+		case "copy":
+			runCopy(os.Args[2:])
+			return
+		case "decrypt":
+			runDecrypt(os.Args[2:])
+			return
+		case "download":
+			runDownload(os.Args[2:])
+			return
+		case "list":
+			runList(os.Args[2:])
+			return
+		case "protect":
+			runProtect(os.Args[2:])
+			return
+		case "prune":
+			runPrune(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "schedule":
+			runSchedule(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "--once":
+			code := runOnce()
+			shutdownTracing(context.Background())
+			os.Exit(code)
+		}
 	}
 
-	s3Client, err := createS3Client(cfg)
+	slog.Info("Starting backup service", "timezone", time.Local.String())
+
+	configs, err := loadConfigs()
 	if err != nil {
-		log.Fatalf("Failed to create S3 client: %v", err)
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Every source block is backed up on its own schedule, to its own
+	// destinations.
+	var backups []func()
+	var primaries []Destination
+	for _, cfg := range configs {
+		destinations, err := setup(cfg)
+		if err != nil {
+			fatalf("Invalid configuration: %v", err)
+		}
+
+		if cfg.BootstrapRestore {
+			if err := bootstrapRestore(cfg); err != nil {
+				fatalf("Failed to restore the latest backup: %v", err)
+			}
+		}
+
+		// Backing up on every start would fill the bucket with near-identical
+		// backups when the container is stuck in a restart loop, so it is
+		// opt-in.
+		if !cfg.SkipInitialBackup {
+			slog.Info("Running initial backup", "job", "backup")
+			go runAndRecord(cfg, destinations, "")
+		} else if cfg.CatchUp {
+			go catchUp(cfg, destinations)
+		}
+
+		if err := scheduleBackup(cfg, destinations); err != nil {
+			fatalf("Failed to schedule backup: %v", err)
+		}
+
+		if cfg.WALShipping {
+			if err := startWALShipping(context.Background(), cfg, destinations); err != nil {
+				fatalf("Failed to start WAL shipping: %v", err)
+			}
+		}
+
+		if cfg.WatchChanges {
+			if err := startWatching(context.Background(), cfg, destinations); err != nil {
+				fatalf("Failed to watch for changes: %v", err)
+			}
+		}
+
+		// Backups triggered by hand run even while backups are paused.
+		backups = append(backups, func() { runBackup(cfg, destinations, "") })
+		primaries = append(primaries, destinations[0])
 	}
 
-	// Run an immediate backup when the service starts
-	// log.Println("Running initial backup...")
-	// runBackup(cfg, s3Client)
+	go backupOnSignal(backups)
 
-	// Schedule daily backups
-	if err := scheduleBackup(cfg, s3Client); err != nil {
-		log.Fatalf("Failed to schedule backup: %v", err)
+	if configs[0].HTTPAddr != "" {
+		if err := startHTTPServer(configs, primaries); err != nil {
+			fatalf("Failed to start HTTP server: %v", err)
+		}
+	}
+	if configs[0].HealthAddr != "" {
+		startHealthServer(configs[0].HealthAddr, configs)
 	}
 
-	log.Println("Backup service started successfully. Waiting for scheduled backups...")
+	slog.Info("Backup service started successfully, waiting for scheduled backups")
 	// Keep the program running indefinitely
 	select {}
-}
\ No newline at end of file
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// backupMetadata describes a backup artifact. It is attached to the uploaded
+// object as user metadata, and as object tags where enabled, so backups can
+// be filtered and lifecycle-managed on the server side.
+func backupMetadata(cfg *Config, source Source, enc Encryptor, filePath string) (map[string]string, error) {
+	checksum, err := fileSHA256(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checksum backup: %w", err)
+	}
+
+	metadata := map[string]string{
+		"db":          source.Name(),
+		"hostname":    hostname(),
+		"backup-type": source.Type(),
+		"compression": cfg.Compression,
+		"encryption":  cfg.Encryption,
+		"sha256":      checksum,
+	}
+
+	for _, v := range []interface{}{source, enc} {
+		if provider, ok := v.(MetadataProvider); ok {
+			for k, v := range provider.Metadata() {
+				metadata[k] = v
+			}
+		}
+	}
+
+	for k, v := range cfg.ObjectTags {
+		metadata[k] = v
+	}
+
+	return metadata, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sqliteUserVersion reads PRAGMA user_version, which applications commonly
+// use as their schema version, straight from the database header.
+func sqliteUserVersion(path string) (uint32, bool) {
+	header, ok := sqliteHeader(path)
+	if !ok {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(header[60:64]), true
+}
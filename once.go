@@ -0,0 +1,40 @@
+package main
+
+import "log/slog"
+
+// Exit codes of --once.
+const (
+	exitOK            = 0
+	exitBackupFailed  = 1
+	exitInvalidConfig = 2
+)
+
+// runOnce implements --once, which backs up every source block a single time
+// and exits instead of scheduling backups, for running the service from an
+// external scheduler like a Kubernetes CronJob or a systemd timer. It returns
+// exitBackupFailed if a source couldn't be backed up and exitInvalidConfig if
+// the configuration is invalid, in which case nothing is backed up.
+func runOnce() int {
+	configs, err := loadConfigs()
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return exitInvalidConfig
+	}
+
+	destinations := make([][]Destination, len(configs))
+	for i, cfg := range configs {
+		if destinations[i], err = setup(cfg); err != nil {
+			slog.Error("Invalid configuration", "error", err)
+			return exitInvalidConfig
+		}
+	}
+
+	code := exitOK
+	for i, cfg := range configs {
+		if !runBackup(cfg, destinations[i], "") {
+			code = exitBackupFailed
+		}
+	}
+
+	return code
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// runArchiveWAL runs the archive-wal command with the arguments %p and %f of
+// archive_command and exits non-zero if archiving failed.
+func runArchiveWAL(args []string) {
+	if len(args) != 2 {
+		fatalf("Usage: archive-wal <path> <file name>")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	destinations, err := newDestinations(cfg)
+	if err != nil {
+		fatalf("Failed to create storage backend: %v", err)
+	}
+
+	if err := archiveWAL(context.Background(), cfg, destinations[0], args[0], args[1]); err != nil {
+		fatalf("Failed to archive WAL file %s: %v", args[1], err)
+	}
+}
+
+// archiveWAL implements the archive-wal command, which is meant to be used as
+// the archive_command of a PostgreSQL server:
+//
+//	archive_command = '/app/backup-app archive-wal %p %f'
+//
+// It uploads the WAL file at walPath as fileName to the primary destination,
+// next to the base backups taken with PG_BACKUP_MODE=basebackup. PostgreSQL
+// only recycles a WAL file after the command succeeded and retries it
+// otherwise, so failures are simply reported.
+func archiveWAL(ctx context.Context, cfg *Config, dest Destination, walPath, fileName string) error {
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL file: %w", err)
+	}
+
+	name := cfg.SourceName
+	if name == "" {
+		name = postgresDatabaseName(cfg.PGConnectionString)
+	}
+	enc, err := newEncryptor(cfg)
+	if err != nil {
+		return err
+	}
+
+	prefix := listPrefix(dest.KeyPrefix, name) + name + "-wal/"
+	key := prefix + fileName + ".gz" + enc.Extension()
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	// PostgreSQL requires the command to refuse overwriting an archived file,
+	// but to succeed when the same file is archived again, which happens when
+	// the server crashed after the upload.
+	exists, err := archivedWALMatches(ctx, dest.Storage, key, data, checksum, cfg.Encryption != "none")
+	if err != nil {
+		return err
+	}
+	if exists {
+		slog.Info("WAL file is already archived", "job", "wal", "source", name, "destination", dest.Name, "key", key)
+		return nil
+	}
+
+	buf, err := gzipEncrypt(bytes.NewReader(data), enc)
+	if err != nil {
+		return fmt.Errorf("failed to archive WAL file: %w", err)
+	}
+
+	metadata := map[string]string{
+		"db":          name,
+		"hostname":    hostname(),
+		"backup-type": "postgres-wal",
+		"encryption":  cfg.Encryption,
+		"sha256":      checksum,
+	}
+	if cfg.Encryption != "none" {
+		// The checksum goes first, so a file is never archived without it.
+		sum := strings.NewReader(checksum)
+		if err := dest.Storage.Put(ctx, key+".sha256", sum, sum.Size(), metadata); err != nil {
+			return fmt.Errorf("failed to upload WAL file checksum: %w", err)
+		}
+	}
+	if err := dest.Storage.Put(ctx, key, buf, int64(buf.Len()), metadata); err != nil {
+		return fmt.Errorf("failed to upload WAL file: %w", err)
+	}
+	slog.Info("Archived WAL file", "job", "wal", "source", name, "destination", dest.Name, "key", key, "bytes", buf.Len())
+
+	// A backup history file is archived at the end of every base backup,
+	// which makes it a good point to drop WAL files that are only needed for
+	// base backups that are gone by now.
+	if strings.HasSuffix(fileName, ".backup") {
+		pruneArchivedWAL(ctx, dest, prefix, name)
+	}
+
+	return nil
+}
+
+// archivedWALMatches reports whether key already exists. It fails if it
+// exists with different contents than data. Encrypted files aren't decrypted
+// to compare them; the checksum archived next to them is compared instead.
+func archivedWALMatches(ctx context.Context, storage StorageBackend, key string, data []byte, checksum string, encrypted bool) (bool, error) {
+	objects, err := storage.List(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to list archived WAL files: %w", err)
+	}
+
+	found := false
+	for _, obj := range objects {
+		if obj.Key == key {
+			found = true
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	if encrypted {
+		r, err := storage.Get(ctx, key+".sha256")
+		if err != nil {
+			return false, fmt.Errorf("failed to download checksum of archived WAL file: %w", err)
+		}
+		defer r.Close()
+
+		archived, err := io.ReadAll(r)
+		if err != nil {
+			return false, fmt.Errorf("failed to download checksum of archived WAL file: %w", err)
+		}
+		if strings.TrimSpace(string(archived)) != checksum {
+			return false, fmt.Errorf("%s is already archived with different contents", key)
+		}
+		return true, nil
+	}
+
+	r, err := storage.Get(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to download archived WAL file: %w", err)
+	}
+	defer r.Close()
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return false, fmt.Errorf("failed to decompress archived WAL file: %w", err)
+	}
+	archived, err := io.ReadAll(gr)
+	if err != nil {
+		return false, fmt.Errorf("failed to decompress archived WAL file: %w", err)
+	}
+
+	if !bytes.Equal(archived, data) {
+		return false, fmt.Errorf("%s is already archived with different contents", key)
+	}
+
+	return true, nil
+}
+
+// pruneArchivedWAL deletes the archived WAL files below prefix that no
+// retained base backup of name on dest needs anymore. Base backups are taken
+// without WAL, so every WAL file from the start of the oldest one on, as
+// recorded in its backup history file, is kept, however old it is. As the
+// history file of a base backup is archived shortly before the backup is
+// uploaded, the newest history file archived before the oldest base backup
+// is taken for it, which errs on the side of keeping WAL.
+func pruneArchivedWAL(ctx context.Context, dest Destination, prefix, name string) {
+	logger := slog.With("job", "prune", "source", name, "destination", dest.Name)
+
+	backups, err := listStoredBackups(ctx, dest, name)
+	if err != nil {
+		logger.Warn("WAL cleanup failed", "error", err)
+		return
+	}
+	if len(backups) == 0 {
+		return
+	}
+	oldest := backups[len(backups)-1]
+
+	objects, err := dest.Storage.List(ctx, prefix)
+	if err != nil {
+		logger.Warn("WAL cleanup failed", "error", err)
+		return
+	}
+
+	var start string
+	var startTime time.Time
+	for _, obj := range objects {
+		segment, ok := walSegment(obj.Key)
+		if !ok || !strings.Contains(path.Base(obj.Key), ".backup") || obj.LastModified.After(oldest.LastModified) {
+			continue
+		}
+		if start == "" || obj.LastModified.After(startTime) {
+			start, startTime = segment, obj.LastModified
+		}
+	}
+	if start == "" {
+		logger.Debug("No backup history file for the oldest base backup, keeping all WAL files", "key", oldest.Key)
+		return
+	}
+
+	for _, obj := range objects {
+		// Like pg_archivecleanup, segments are compared without their
+		// timeline. Timeline history files are always kept.
+		segment, ok := walSegment(obj.Key)
+		if !ok || segment[8:] >= start[8:] {
+			continue
+		}
+		if err := dest.Storage.Delete(ctx, obj.Key); err != nil {
+			logger.Error("Failed to delete old WAL file", "key", obj.Key, "error", err)
+		}
+	}
+}
+
+// walSegment returns the name of the WAL segment the archived file at key
+// belongs to, which is the start of the name of WAL files, their checksums
+// and backup history files.
+func walSegment(key string) (string, bool) {
+	name := path.Base(key)
+	if len(name) < 24 || strings.Trim(name[:24], "0123456789ABCDEF") != "" {
+		return "", false
+	}
+
+	return name[:24], true
+}
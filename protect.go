@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+)
+
+// runProtect implements the protect command, which marks backups as
+// protected in the catalog of their source on every destination, so the
+// retention sweep never deletes them, e.g. before a migration:
+//
+//	backup-app protect backups/app_backup_20240101_020000.sql.gz
+//
+// With --remove, the backups are unprotected again and expire as usual. The
+// command exits with 1 if a backup couldn't be protected on a destination.
+func runProtect(args []string) {
+	flags := flag.NewFlagSet("protect", flag.ExitOnError)
+	remove := flags.Bool("remove", false, "unprotect the backups")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fatalf("Usage: protect [--remove] <key>...")
+	}
+
+	configs, err := loadConfigs()
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	ctx := context.Background()
+	failed := false
+	for _, key := range flags.Args() {
+		cfg, dbName, err := sourceOfBackup(configs, key)
+		if err != nil {
+			fatalf("Failed to protect %s: %v", key, err)
+		}
+		destinations, err := newDestinations(cfg)
+		if err != nil {
+			fatalf("Failed to create storage backend: %v", err)
+		}
+
+		for _, dest := range destinations {
+			if err := protectBackup(ctx, dest, dbName, key, !*remove); err != nil {
+				slog.Error("Failed to protect backup", "destination", dest.Name, "key", key, "error", err)
+				failed = true
+				continue
+			}
+			if *remove {
+				slog.Info("Unprotected backup", "job", "protect", "source", dbName, "destination", dest.Name, "key", key)
+			} else {
+				slog.Info("Protected backup", "job", "protect", "source", dbName, "destination", dest.Name, "key", key)
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// sourceOfBackup returns the configuration and name of the source the backup
+// at key was made of, among the sources of configs.
+func sourceOfBackup(configs []*Config, key string) (*Config, string, error) {
+	for _, cfg := range configs {
+		sources, err := newSources(cfg)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create backup source: %w", err)
+		}
+		for _, source := range sources {
+			if strings.HasPrefix(path.Base(key), source.Name()+"_backup_") {
+				return cfg, source.Name(), nil
+			}
+		}
+	}
+
+	return nil, "", fmt.Errorf("no source makes backups named like %s", path.Base(key))
+}
+
+// protectBackup sets whether the backup of dbName named like key is
+// protected in its catalog on dest. The backup is looked up by name, as the
+// key prefix can differ between destinations.
+func protectBackup(ctx context.Context, dest Destination, dbName, key string, protected bool) error {
+	catalog, err := readCatalog(ctx, dest, dbName)
+	if errors.Is(err, errNoCatalog) {
+		catalog, err = listedCatalog(ctx, dest, dbName)
+	}
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i, entry := range catalog.Backups {
+		if path.Base(entry.Key) == path.Base(key) {
+			catalog.Backups[i].Protected = protected
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("backup not found")
+	}
+
+	return writeCatalog(ctx, dest, dbName, catalog)
+}
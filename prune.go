@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+)
+
+// runPrune implements the prune command, which applies the retention policy
+// to the backups of every source on every destination right away, rather
+// than after the next backup, e.g. to free space after lowering
+// RETENTION_DAYS:
+//
+//	backup-app prune --dry-run
+//
+// With --dry-run, the backups that would be deleted are only logged, as with
+// RETENTION_DRY_RUN. The command exits with 1 if a destination couldn't be
+// pruned.
+func runPrune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only log the backups that would be deleted, and why")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		fatalf("Usage: prune [--dry-run]")
+	}
+
+	configs, err := loadConfigs()
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	ctx := context.Background()
+	failed := false
+	for _, cfg := range configs {
+		destinations, err := newDestinations(cfg)
+		if err != nil {
+			fatalf("Failed to create storage backend: %v", err)
+		}
+		sources, err := newSources(cfg)
+		if err != nil {
+			fatalf("Failed to create backup source: %v", err)
+		}
+
+		for _, dest := range destinations {
+			dest.Retention.DryRun = dest.Retention.DryRun || *dryRun
+			for _, source := range sources {
+				deleted, err := cleanupOldBackups(ctx, dest, source.Name())
+				if err != nil {
+					slog.Error("Failed to prune backups", "job", "prune", "source", source.Name(), "destination", dest.Name, "error", err)
+					failed = true
+					continue
+				}
+				if err := removeFromCatalog(ctx, dest, source.Name(), deleted); err != nil {
+					slog.Warn("Catalog update failed", "job", "prune", "source", source.Name(), "destination", dest.Name, "error", err)
+				}
+				if !dest.Retention.DryRun {
+					slog.Info("Pruned backups", "job", "prune", "source", source.Name(), "destination", dest.Name, "deleted", len(deleted))
+				}
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
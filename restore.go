@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// runRestore implements the restore command, which downloads a backup from
+// the primary destination, decrypts and decompresses it, and writes it to a
+// target path, DB_PATH by default:
+//
+//	backup-app restore backups/app_backup_20240101_020000.sql.gz /data/app.db
+//
+// With --latest, the most recent backup is restored instead of a given one:
+//
+//	backup-app restore --latest /data/app.db
+//
+// With --path, only the given paths are restored from a directory backup:
+//
+//	backup-app restore --path uploads/avatar.png backups/data_backup_20240101_020000.tar.gz
+//
+// With --wal, the latest state replicated with WAL_SHIPPING is restored:
+//
+//	backup-app restore --wal /data/app.db
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := flags.Bool("force", false, "replace an existing file at the target path")
+	latest := flags.Bool("latest", false, "restore the most recent backup")
+	dryRun := flags.Bool("dry-run", false, "download, decrypt and decompress the backup without writing it")
+	source := flags.String("source", "", "with --latest or --wal, the source to restore if there are several")
+	wal := flags.Bool("wal", false, "restore the latest state replicated with WAL_SHIPPING")
+	generation := flags.String("generation", "", "with --wal, the WAL generation to restore instead of the latest")
+	var paths pathsFlag
+	flags.Var(&paths, "path", "restore only this path from a directory backup, can be given several times")
+	flags.Parse(args)
+	usage := "Usage: restore [--force] [--dry-run] [--path <path>]... (<key> | --latest [--source <name>] | --wal [--source <name>] [--generation <name>]) [target path]"
+	ctx := context.Background()
+
+	if *wal {
+		if *latest || *dryRun || len(paths) > 0 || flags.NArg() > 1 {
+			fatalf(usage)
+		}
+
+		configs, err := loadRestoreConfigs()
+		if err != nil {
+			fatalf("Failed to load configuration: %v", err)
+		}
+		c, err := findSource(configs, *source)
+		if err != nil {
+			fatalf("Failed to restore from WAL: %v", err)
+		}
+		destinations, err := newDestinations(c.cfg)
+		if err != nil {
+			fatalf("Failed to create storage backend: %v", err)
+		}
+		target, err := restoreTarget(c.cfg, c.name+".db", flags.Arg(0))
+		if err != nil {
+			fatalf("Failed to restore %s from WAL: %v", c.name, err)
+		}
+		if err := restoreWAL(ctx, c.cfg, destinations[0], c.name, *generation, target, *force); err != nil {
+			fatalf("Failed to restore %s from WAL: %v", c.name, err)
+		}
+		return
+	}
+
+	if *latest && flags.NArg() > 1 || !*latest && (flags.NArg() < 1 || flags.NArg() > 2) {
+		fatalf(usage)
+	}
+
+	var cfg *Config
+	var dest Destination
+	var key, target string
+	if *latest {
+		configs, err := loadRestoreConfigs()
+		if err != nil {
+			fatalf("Failed to load configuration: %v", err)
+		}
+
+		if cfg, dest, key, err = latestBackup(ctx, configs, *source); err != nil {
+			fatalf("Failed to find the latest backup: %v", err)
+		}
+		slog.Info("Found the latest backup", "job", "restore", "destination", dest.Name, "key", key)
+		target = flags.Arg(0)
+	} else {
+		var err error
+		if cfg, err = loadRestoreConfig(); err != nil {
+			fatalf("Failed to load configuration: %v", err)
+		}
+
+		destinations, err := newDestinations(cfg)
+		if err != nil {
+			fatalf("Failed to create storage backend: %v", err)
+		}
+		dest, key, target = destinations[0], flags.Arg(0), flags.Arg(1)
+	}
+
+	if len(paths) > 0 {
+		dest, key = restoreSource(ctx, cfg, dest, key)
+		if err := restorePaths(ctx, cfg, dest, key, target, paths, *force, *dryRun); err != nil {
+			fatalf("Failed to restore %s: %v", key, err)
+		}
+		return
+	}
+
+	target, err := restoreTarget(cfg, key, target)
+	if err != nil {
+		fatalf("Failed to restore %s: %v", key, err)
+	}
+	dest, key = restoreSource(ctx, cfg, dest, key)
+	if *dryRun {
+		err = dryRunRestore(ctx, cfg, dest, key, target, *force)
+	} else {
+		err = restoreBackup(ctx, cfg, dest, key, target, *force)
+	}
+	if err != nil {
+		fatalf("Failed to restore %s: %v", key, err)
+	}
+}
+
+// restoreTarget returns where the backup at key is restored to. Without a
+// target, it is the original database at DB_PATH. A directory as the target
+// restores the backup into it under its own name, like
+// app_backup_20240101_020000.sql, e.g. to inspect it side by side with the
+// live database.
+func restoreTarget(cfg *Config, key, target string) (string, error) {
+	if target == "" {
+		if cfg.DBPath == "" || strings.ContainsAny(cfg.DBPath, "*?[") {
+			return "", fmt.Errorf("no target path given")
+		}
+		return cfg.DBPath, nil
+	}
+
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		_, _, name, err := backupEncoding(cfg, key)
+		if err != nil {
+			return "", err
+		}
+		if bundledDump(name) != "" {
+			name = strings.TrimSuffix(name, ".tar")
+		}
+		return filepath.Join(target, name), nil
+	}
+
+	return target, nil
+}
+
+// latestBackup finds the most recent backup of the source named name on the
+// primary destination of its source block, or of the only source if name is
+// empty. Split backups only count once their manifest was uploaded, so an
+// interrupted backup is never picked. If the destination can't be listed,
+// the most recent backup kept in BACKUP_DIR is picked instead.
+func latestBackup(ctx context.Context, configs []*Config, name string) (*Config, Destination, string, error) {
+	c, err := findSource(configs, name)
+	if err != nil {
+		return nil, Destination{}, "", err
+	}
+	destinations, err := newDestinations(c.cfg)
+	if err != nil {
+		return nil, Destination{}, "", err
+	}
+	key, err := latestBackupKey(ctx, destinations[0], c.name)
+	if err != nil {
+		local, lerr := localBackups(c.cfg, c.name)
+		if lerr != nil || len(local) == 0 {
+			return nil, Destination{}, "", err
+		}
+		slog.Warn("Listing backups failed, restoring the latest local copy instead", "destination", destinations[0].Name, "dir", c.cfg.BackupDir, "error", err)
+		return c.cfg, localDestination(c.cfg), local[0].Key, nil
+	}
+	if key == "" {
+		return nil, Destination{}, "", fmt.Errorf("no backups of %s on %s", c.name, destinations[0].Name)
+	}
+
+	return c.cfg, destinations[0], key, nil
+}
+
+// restoreCandidate is a source to restore and the source block it is
+// configured in.
+type restoreCandidate struct {
+	cfg  *Config
+	name string
+}
+
+// findSource returns the source named name among the sources of configs, or
+// the only source if name is empty.
+func findSource(configs []*Config, name string) (restoreCandidate, error) {
+	var candidates []restoreCandidate
+	var names []string
+	for _, cfg := range configs {
+		sources, err := newSources(cfg)
+		if err != nil {
+			return restoreCandidate{}, err
+		}
+		for _, source := range sources {
+			names = append(names, source.Name())
+			if name == "" || source.Name() == name {
+				candidates = append(candidates, restoreCandidate{cfg: cfg, name: source.Name()})
+			}
+		}
+	}
+
+	switch {
+	case len(candidates) == 0:
+		return restoreCandidate{}, fmt.Errorf("no source named %q (available: %s)", name, strings.Join(names, ", "))
+	case len(candidates) > 1:
+		return restoreCandidate{}, fmt.Errorf("several sources are backed up, choose one with --source (available: %s)", strings.Join(names, ", "))
+	}
+
+	return candidates[0], nil
+}
+
+// restoreBackup restores the backup at key on dest to target. The backup is
+// written next to target first and only moved into place once it was
+// downloaded completely and, for SQLite databases, passed an integrity
+// check, so a failed restore never leaves a half-written database behind.
+// An existing file is only replaced with force, and is kept with a
+// .before-restore suffix.
+func restoreBackup(ctx context.Context, cfg *Config, dest Destination, key, target string, force bool) error {
+	mode, err := checkTarget(target, force)
+	if err != nil {
+		return err
+	}
+	_, _, name, err := backupEncoding(cfg, key)
+	if err != nil {
+		return err
+	}
+
+	plain, err := openRestore(ctx, cfg, dest, key)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+
+	// Only the dump is restored from a bundle, not the files bundled with it.
+	var dump io.Reader = plain
+	if entry := bundledDump(name); entry != "" {
+		if dump, err = openBundledDump(plain, entry); err != nil {
+			return err
+		}
+		slog.Info("Restoring the dump from the bundle, download it for the bundled files", "job", "restore", "destination", dest.Name, "key", key, "file", entry)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".restore-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// The restored file gets the permissions of the one it replaces, as
+	// CreateTemp creates files only the owner can read.
+	if err := tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	if _, err := io.Copy(tmp, dump); err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+	// The rest of a bundle is read as well, for the checksum of the backup
+	// to be checked.
+	if _, err := io.Copy(io.Discard, plain); err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	if _, ok := sqliteHeader(tmp.Name()); ok {
+		if err := sqliteIntegrityCheck(ctx, tmp.Name(), "full"); err != nil {
+			return fmt.Errorf("restored database is corrupt: %w", err)
+		}
+	}
+
+	if err := replaceTarget(ctx, cfg, tmp.Name(), target); err != nil {
+		return err
+	}
+
+	slog.Info("Restored backup", "job", "restore", "destination", dest.Name, "key", key, "path", target)
+	return nil
+}
+
+// replaceTarget moves the restored file at restored into place at target.
+// Replacing an existing file runs RESTORE_PRE_COMMAND first, e.g. to stop the
+// application, and RESTORE_POST_COMMAND afterwards, whether the replace
+// worked or not. An SQLite database is locked exclusively while it is moved
+// aside, so the restore fails rather than pull the database out from under a
+// connection writing to it.
+func replaceTarget(ctx context.Context, cfg *Config, restored, target string) error {
+	if _, err := os.Stat(target); err != nil {
+		return moveIntoPlace(restored, target)
+	}
+
+	if err := runHook(ctx, "RESTORE_PRE_COMMAND", cfg.RestorePreCommand); err != nil {
+		return err
+	}
+	defer func() {
+		if err := runHook(ctx, "RESTORE_POST_COMMAND", cfg.RestorePostCommand); err != nil {
+			slog.Warn("Restore hook failed", "error", err)
+		}
+	}()
+
+	if _, ok := sqliteHeader(target); ok {
+		unlock, err := lockSQLite(ctx, target)
+		if err != nil {
+			return fmt.Errorf("%s is in use, stop the application using it first: %w", target, err)
+		}
+		defer unlock()
+	}
+
+	// A -wal or -journal file left behind by the old database would be
+	// applied to the restored one and corrupt it, so it is moved aside along
+	// with the database.
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		err := os.Rename(target+suffix, target+suffix+".before-restore")
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to move %s aside: %w", target+suffix, err)
+		}
+	}
+	slog.Info("Moved existing file aside", "job", "restore", "path", target, "moved_to", target+".before-restore")
+
+	return moveIntoPlace(restored, target)
+}
+
+// moveIntoPlace renames restored to target and syncs the directory, so the
+// rename survives a crash.
+func moveIntoPlace(restored, target string) error {
+	if err := os.Rename(restored, target); err != nil {
+		return fmt.Errorf("failed to move restored backup into place: %w", err)
+	}
+
+	dir, err := os.Open(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// runHook runs command, set with the variable name, with sh -c.
+func runHook(ctx context.Context, name, command string) error {
+	if command == "" {
+		return nil
+	}
+
+	slog.Info("Running restore hook", "job", "restore", "hook", name, "command", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+
+	return nil
+}
+
+// checkTarget checks that a backup can be restored to target, which it can't
+// be if there is a file already, unless with force. It returns the mode of
+// the restored file, which is that of the file it replaces.
+func checkTarget(target string, force bool) (os.FileMode, error) {
+	info, err := os.Stat(target)
+	if err != nil {
+		return 0644, nil
+	}
+	if info.IsDir() {
+		return 0, fmt.Errorf("%s is a directory", target)
+	}
+	if !force {
+		return 0, fmt.Errorf("%s already exists, restore with --force to replace it", target)
+	}
+
+	return info.Mode().Perm(), nil
+}
+
+// dryRunRestore rehearses restoring the backup at key on dest to target
+// without writing anything.
+func dryRunRestore(ctx context.Context, cfg *Config, dest Destination, key, target string, force bool) error {
+	if _, err := checkTarget(target, force); err != nil {
+		return err
+	}
+
+	size, err := checkBackup(ctx, cfg, dest, key)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Dry run: backup can be restored, nothing was written", "job", "restore", "destination", dest.Name, "key", key, "path", target, "bytes", size)
+	return nil
+}
+
+// checkBackup downloads the backup at key on dest, and decrypts and
+// decompresses it without writing it anywhere. That detects a backup that is
+// corrupt, truncated or encrypted with a key that isn't configured, as
+// decryption and decompression authenticate and checksum the data. It
+// returns the size of the restored data.
+func checkBackup(ctx context.Context, cfg *Config, dest Destination, key string) (int64, error) {
+	plain, err := openRestore(ctx, cfg, dest, key)
+	if err != nil {
+		return 0, err
+	}
+	defer plain.Close()
+
+	size, err := io.Copy(io.Discard, plain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to restore backup: %w", err)
+	}
+
+	return size, nil
+}
+
+// openRestore returns the restore pipeline for the backup at key on dest,
+// the reverse of createBackup: the backup is downloaded, put back together
+// if it was split, decrypted and decompressed as told by the extensions of
+// its name, all as a stream. Once the restored data was read to the end, the
+// download is checked against the sha256 metadata of the backup, where the
+// backend returns it, and reading fails if it doesn't match.
+func openRestore(ctx context.Context, cfg *Config, dest Destination, key string) (io.ReadCloser, error) {
+	body, err := openBackup(ctx, dest.Storage, key)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.New()
+	stored := io.TeeReader(body, sum)
+	plain, err := decodeBackup(cfg, key, stored)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return &restoreReader{ctx: ctx, dest: dest, key: key, body: body, stored: stored, sum: sum, plain: plain}, nil
+}
+
+type restoreReader struct {
+	ctx  context.Context
+	dest Destination
+	key  string
+
+	body   io.ReadCloser
+	stored io.Reader
+	sum    hash.Hash
+	plain  io.Reader
+	done   bool
+}
+
+func (r *restoreReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+
+	n, err := r.plain.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	// Decompressors may stop short of the end of the stored backup, the
+	// rest is still needed for its checksum.
+	if _, err := io.Copy(io.Discard, r.stored); err != nil {
+		return n, fmt.Errorf("failed to download backup: %w", err)
+	}
+	if err := checkSHA256(r.ctx, r.dest, r.key, r.sum.Sum(nil)); err != nil {
+		return n, err
+	}
+
+	r.done = true
+	return n, io.EOF
+}
+
+func (r *restoreReader) Close() error {
+	return r.body.Close()
+}
+
+// checkSHA256 checks sum, the checksum of the backup at key as it is stored,
+// against its sha256 metadata where the backend of dest returns it.
+func checkSHA256(ctx context.Context, dest Destination, key string, sum []byte) error {
+	expected := metadataSHA256(ctx, dest, key)
+	if expected != "" && expected != hex.EncodeToString(sum) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %x", expected, sum)
+	}
+
+	return nil
+}
+
+// metadataSHA256 returns the sha256 metadata of the backup at key, or an
+// empty string if the backend of dest doesn't return it.
+func metadataSHA256(ctx context.Context, dest Destination, key string) string {
+	reader, ok := dest.Storage.(MetadataReader)
+	if !ok {
+		return ""
+	}
+
+	metadata, err := reader.Metadata(ctx, key)
+	if err != nil {
+		return ""
+	}
+
+	return metadata["sha256"]
+}
+
+// openBackup downloads the backup at key from storage, putting it back
+// together from its parts if it was split.
+func openBackup(ctx context.Context, storage StorageBackend, key string) (io.ReadCloser, error) {
+	r, err := storage.Get(ctx, key)
+	if err == nil {
+		return r, nil
+	}
+
+	manifest, merr := readManifest(ctx, storage, key)
+	if merr != nil {
+		return nil, fmt.Errorf("failed to download backup: %w", err)
+	}
+
+	return openSplit(ctx, storage, key, manifest), nil
+}
+
+// decodeBackup decrypts and decompresses the backup at key read from r.
+func decodeBackup(cfg *Config, key string, r io.Reader) (io.Reader, error) {
+	decrypter, comp, _, err := backupEncoding(cfg, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if decrypter != nil {
+		if r, err = decrypter(cfg, r); err != nil {
+			return nil, fmt.Errorf("failed to decrypt backup: %w", err)
+		}
+	}
+	if r, err = comp.NewReader(r); err != nil {
+		return nil, fmt.Errorf("failed to decompress backup: %w", err)
+	}
+
+	return r, nil
+}
+
+// backupEncoding tells from the extensions of the backup at key how it was
+// encrypted, if at all, and compressed, and returns its name without them.
+func backupEncoding(cfg *Config, key string) (decrypterFactory, Compressor, string, error) {
+	name := path.Base(key)
+
+	var decrypter decrypterFactory
+	for extension, factory := range decrypters {
+		if strings.HasSuffix(name, extension) {
+			decrypter, name = factory, strings.TrimSuffix(name, extension)
+			break
+		}
+	}
+
+	for _, factory := range compressors {
+		comp, err := factory(cfg)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if comp.Extension() != "" && strings.HasSuffix(name, comp.Extension()) {
+			return decrypter, comp, strings.TrimSuffix(name, comp.Extension()), nil
+		}
+	}
+
+	return decrypter, noCompressor{}, name, nil
+}
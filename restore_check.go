@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// checkRestores proves that the backups are restorable by restoring the
+// latest backup of every source from the primary destination into a
+// temporary directory, which is removed again afterwards. Restores are
+// checked like any other, so SQLite databases also have to pass an
+// integrity check.
+func checkRestores(cfg *Config, destinations []Destination) {
+	ctx := context.Background()
+
+	sources, err := newSources(cfg)
+	if err != nil {
+		slog.Error("Restore check FAILED", "job", "verify", "error", err)
+		return
+	}
+
+	for _, source := range sources {
+		if err := checkRestore(ctx, cfg, destinations[0], source.Name()); err != nil {
+			slog.Error("Restore check FAILED", "job", "verify", "source", source.Name(), "error", err)
+		}
+	}
+}
+
+func checkRestore(ctx context.Context, cfg *Config, dest Destination, dbName string) error {
+	key, err := latestBackupKey(ctx, dest, dbName)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("no backups on %s", dest.Name)
+	}
+
+	dir, err := os.MkdirTemp(cfg.BackupDir, "restore-check-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, dbName)
+	if err := restoreBackup(ctx, cfg, dest, key, target, false); err != nil {
+		return err
+	}
+
+	slog.Info("Restore check passed: latest backup is restorable", "job", "verify", "source", dbName, "destination", dest.Name, "key", key)
+	return nil
+}
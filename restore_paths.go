@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pathsFlag collects the values of a flag that can be given several times.
+type pathsFlag []string
+
+func (f *pathsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *pathsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// restorePaths restores the files matching paths from the directory backup
+// at key on dest into the directory target, DIR_PATH by default. The archive
+// is read as a stream and everything else in it is skipped. Paths are
+// matched like DIR_INCLUDE, so uploads/avatar.png restores a single file and
+// uploads everything below that directory. Existing files are only replaced
+// with force.
+func restorePaths(ctx context.Context, cfg *Config, dest Destination, key, target string, paths []string, force, dryRun bool) error {
+	_, _, name, err := backupEncoding(cfg, key)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(name, ".tar") {
+		return fmt.Errorf("only directory backups can be restored selectively, %s is not a tar archive", key)
+	}
+
+	if target == "" {
+		target = cfg.DirPath
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		return fmt.Errorf("target %q is not a directory", target)
+	}
+
+	plain, err := openRestore(ctx, cfg, dest, key)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+
+	tr := tar.NewReader(plain)
+	restored := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		rel := strings.TrimSuffix(hdr.Name, "/")
+		if !matchesAny(paths, rel) {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return fmt.Errorf("refusing to restore %s outside of %s", hdr.Name, target)
+		}
+
+		dst := filepath.Join(target, filepath.FromSlash(rel))
+		if dryRun {
+			slog.Info("Dry run: would restore path", "job", "restore", "key", key, "file", rel, "path", dst)
+		} else {
+			if err := checkInside(target, dst); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", rel, err)
+			}
+			if err := extractEntry(tr, hdr, dst, force); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", rel, err)
+			}
+			slog.Info("Restored path", "job", "restore", "key", key, "file", rel, "path", dst)
+		}
+		restored++
+	}
+
+	// The rest of the backup is still needed for its checksum.
+	if _, err := io.Copy(io.Discard, plain); err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+	if restored == 0 {
+		return fmt.Errorf("nothing in %s matches %s", key, strings.Join(paths, ", "))
+	}
+
+	if dryRun {
+		slog.Info("Dry run: paths can be restored, nothing was written", "job", "restore", "destination", dest.Name, "key", key, "files", strings.Join(paths, ","), "path", target)
+		return nil
+	}
+	slog.Info("Restored paths", "job", "restore", "destination", dest.Name, "key", key, "files", strings.Join(paths, ","), "path", target)
+	return nil
+}
+
+// checkInside fails if the directory dst is written to resolves outside of
+// target. The names of entries are only checked lexically, but a symlink
+// restored before, like uploads pointing to /etc, would have later entries
+// written through it.
+func checkInside(target, dst string) error {
+	root, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return err
+	}
+
+	// Directories that don't exist yet are created below the nearest one
+	// that does.
+	dir := filepath.Dir(dst)
+	resolved, err := filepath.EvalSymlinks(dir)
+	for os.IsNotExist(err) && dir != filepath.Dir(dir) {
+		dir = filepath.Dir(dir)
+		resolved, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if rel, err := filepath.Rel(root, resolved); err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+		return fmt.Errorf("refusing to write through %s, which leads outside of %s", dir, target)
+	}
+
+	return nil
+}
+
+// extractEntry writes the directory, regular file or symlink described by
+// hdr, read from tr, to dst. Regular files are written next to dst first and
+// renamed into place, so a failed restore never leaves a half-written file
+// behind.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dst string, force bool) error {
+	mode := hdr.FileInfo().Mode().Perm()
+	if hdr.Typeflag == tar.TypeDir {
+		return os.MkdirAll(dst, mode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil && !force {
+		return fmt.Errorf("%s already exists, restore with --force to replace it", dst)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, dst)
+	case tar.TypeReg:
+		tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".restore-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		if err := tmp.Chmod(mode); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tmp, tr); err != nil {
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Chtimes(tmp.Name(), hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), dst)
+	}
+
+	return nil
+}
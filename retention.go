@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// retentionPolicy decides which backups of a source are kept on a
+// destination. By default, backups are kept for Days. Where any of the
+// counts is set, backups are kept by count instead, however old they are:
+// the Count newest backups, and, for a grandfather-father-son policy, the
+// newest backup of each of the last Daily days, Weekly weeks, Monthly months
+// and Yearly years. Of those, only the newest backups that fit into MaxSize
+// together are kept, if it is set. The newest backup, or the MinCount newest
+// ones, are always kept, however old or large they are, so a source whose
+// backups stopped is never left without one.
+// Backups of the tiers in TierDays are kept for their days instead, apart
+// from the others.
+type retentionPolicy struct {
+	Days     int
+	Count    int
+	Daily    int
+	Weekly   int
+	Monthly  int
+	Yearly   int
+	MaxSize  int64
+	MinCount int
+	TierDays map[string]int
+	// ArchiveDays moves expired backups under ArchivePrefix and keeps them
+	// there for as many days before deleting them.
+	ArchiveDays   int
+	ArchivePrefix string
+	// Tier is the tier the policy applies to, if it only applies to one.
+	Tier string
+	// DryRun only logs the backups that would be deleted, and why.
+	DryRun bool
+}
+
+// newRetentionPolicy returns the retention policy of cfg, keeping backups
+// for days unless they are kept by count.
+func newRetentionPolicy(cfg *Config, days int) retentionPolicy {
+	return retentionPolicy{
+		Days:          days,
+		Count:         cfg.RetentionCount,
+		Daily:         cfg.RetentionDaily,
+		Weekly:        cfg.RetentionWeekly,
+		Monthly:       cfg.RetentionMonthly,
+		Yearly:        cfg.RetentionYearly,
+		MaxSize:       cfg.RetentionMaxSize,
+		MinCount:      cfg.RetentionMinCount,
+		TierDays:      cfg.TierRetentionDays,
+		ArchiveDays:   cfg.ArchiveDays,
+		ArchivePrefix: cfg.ArchivePrefix,
+		DryRun:        cfg.RetentionDryRun,
+	}
+}
+
+// byCount reports whether p keeps backups by count rather than by age.
+func (p retentionPolicy) byCount() bool {
+	return p.Count > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Yearly > 0
+}
+
+// expiredBackup is a backup a retention policy doesn't keep, and why.
+type expiredBackup struct {
+	storedBackup
+	Reason string
+}
+
+// expired returns the backups that p doesn't keep. backups must be sorted
+// newest first. Backups kept only as the newest ones are logged to logger.
+func (p retentionPolicy) expired(backups []storedBackup, now time.Time, logger *slog.Logger) []expiredBackup {
+	if len(p.TierDays) > 0 {
+		return p.expiredByTier(backups, now, logger)
+	}
+	kept := p.kept(backups, now)
+
+	// The newest backup is always kept, and with MinCount as many.
+	floor := max(p.MinCount, 1)
+
+	var expired []expiredBackup
+	var total int64
+	for i, backup := range backups {
+		if !kept[backup.Key] {
+			if i >= floor {
+				expired = append(expired, expiredBackup{backup, p.reason()})
+				continue
+			}
+			if p.MinCount > 1 {
+				logger.Info(fmt.Sprintf("Keeping backup as it is one of the RETENTION_MIN_COUNT of %d newest backups", p.MinCount), "key", backup.Key, "reason", p.reason())
+			} else if p.Tier != "" {
+				logger.Info("Keeping backup as it is the last backup of its tier", "key", backup.Key, "tier", p.Tier, "reason", p.reason())
+			} else {
+				logger.Info("Keeping backup as it is the last backup of its source", "key", backup.Key, "reason", p.reason())
+			}
+		}
+
+		total += backup.size()
+		if p.MaxSize > 0 && total > p.MaxSize && i >= floor {
+			reason := fmt.Sprintf("together with the newer backups, it exceeds RETENTION_MAX_SIZE of %s", formatSize(p.MaxSize))
+			expired = append(expired, expiredBackup{backup, reason})
+		}
+	}
+	return expired
+}
+
+// expiredByTier applies the days of each tier in TierDays to the backups of
+// that tier, and the rest of p to the other backups.
+func (p retentionPolicy) expiredByTier(backups []storedBackup, now time.Time, logger *slog.Logger) []expiredBackup {
+	byTier := map[string][]storedBackup{}
+	for _, backup := range backups {
+		tier := backupTier(backup.Key)
+		if _, ok := p.TierDays[tier]; !ok {
+			tier = ""
+		}
+		byTier[tier] = append(byTier[tier], backup)
+	}
+
+	rest := p
+	rest.TierDays = nil
+	expired := rest.expired(byTier[""], now, logger)
+	for tier, days := range p.TierDays {
+		policy := retentionPolicy{Days: days, MinCount: p.MinCount, Tier: tier}
+		expired = append(expired, policy.expired(byTier[tier], now, logger)...)
+	}
+	return expired
+}
+
+// backupTier returns the tier in the name of the backup at key, the part
+// between _backup_ and the timestamp, or an empty string.
+func backupTier(key string) string {
+	name := path.Base(key)
+	i := strings.LastIndex(name, "_backup_")
+	if i < 0 {
+		return ""
+	}
+
+	tier, _, _ := strings.Cut(name[i+len("_backup_"):], "_")
+	if strings.Trim(tier, "0123456789") == "" {
+		return ""
+	}
+	return tier
+}
+
+// reason tells why p doesn't keep a backup by age or by count.
+func (p retentionPolicy) reason() string {
+	if p.Tier != "" {
+		return fmt.Sprintf("older than RETENTION_DAYS_%s of %d days", strings.ToUpper(strings.ReplaceAll(p.Tier, "-", "_")), p.Days)
+	}
+	if !p.byCount() {
+		return fmt.Sprintf("older than RETENTION_DAYS of %d days", p.Days)
+	}
+
+	var kept []string
+	if p.Count > 0 {
+		kept = append(kept, fmt.Sprintf("one of the %d newest backups", p.Count))
+	}
+	for _, rule := range []struct {
+		count int
+		unit  string
+	}{{p.Daily, "days"}, {p.Weekly, "weeks"}, {p.Monthly, "months"}, {p.Yearly, "years"}} {
+		if rule.count > 0 {
+			kept = append(kept, fmt.Sprintf("the newest of the last %d %s", rule.count, rule.unit))
+		}
+	}
+	return "not " + strings.Join(kept, ", nor ")
+}
+
+// kept returns the keys of the backups that p keeps by age or by count.
+func (p retentionPolicy) kept(backups []storedBackup, now time.Time) map[string]bool {
+	kept := map[string]bool{}
+	if !p.byCount() {
+		cutoff := now.AddDate(0, 0, -p.Days)
+		for _, backup := range backups {
+			kept[backup.Key] = !backup.Time.Before(cutoff)
+		}
+		return kept
+	}
+
+	rules := []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	for i, backup := range backups {
+		if i < p.Count {
+			kept[backup.Key] = true
+		}
+	}
+	for _, rule := range rules {
+		periods := map[string]bool{}
+		for _, backup := range backups {
+			period := rule.period(backup.Time.Local())
+			if periods[period] {
+				continue
+			}
+			if len(periods) == rule.count {
+				break
+			}
+			periods[period] = true
+			kept[backup.Key] = true
+		}
+	}
+
+	return kept
+}
+
+// configureLifecycle sets up a lifecycle rule on the bucket of every
+// destination that supports one, expiring the backups of every source of cfg
+// after the days of its retention policy, so they expire even while the
+// service is down. Policies by count, size or tier can't be expressed as a
+// rule, and destinations with one are left alone.
+func configureLifecycle(ctx context.Context, cfg *Config, destinations []Destination) error {
+	sources, err := newSources(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, dest := range destinations {
+		configurer, ok := dest.Storage.(LifecycleConfigurer)
+		if !ok {
+			slog.Info("BUCKET_LIFECYCLE is not supported, relying on the retention sweep", "job", "prune", "destination", dest.Name)
+			continue
+		}
+		if dest.Retention.byCount() || dest.Retention.MaxSize > 0 || dest.Retention.MinCount > 0 || dest.Retention.ArchiveDays > 0 || len(dest.Retention.TierDays) > 0 {
+			slog.Info("Retention is not by age alone, not configuring a bucket lifecycle", "job", "prune", "destination", dest.Name)
+			continue
+		}
+
+		for _, source := range sources {
+			// Where the key prefix doesn't depend on the time of the
+			// backup, the rule only matches the backups of the source, and
+			// not its catalog and latest pointer.
+			prefix := listPrefix(dest.KeyPrefix, source.Name())
+			if prefix == renderKeyPrefix(dest.KeyPrefix, source.Name(), time.Time{}) {
+				prefix += source.Name() + "_backup_"
+			}
+			if err := configurer.SetLifecycle(ctx, prefix, dest.Retention.Days); err != nil {
+				return err
+			}
+			slog.Info("Configured bucket lifecycle", "job", "prune", "source", source.Name(), "destination", dest.Name, "prefix", prefix, "days", dest.Retention.Days)
+		}
+	}
+
+	return nil
+}
+
+// storedBackup is a backup on a destination with the objects it is stored
+// as, which are several for a split backup.
+type storedBackup struct {
+	Key     string
+	Time    time.Time
+	Objects []BackupObject
+}
+
+// size returns the size of all objects of b.
+func (b storedBackup) size() int64 {
+	var size int64
+	for _, obj := range b.Objects {
+		size += obj.Size
+	}
+
+	return size
+}
+
+// storedBackups groups the objects of the backups of dbName among objects by
+// backup, newest first. Other objects, such as the backups of other sources
+// sharing a prefix, are left out.
+func storedBackups(objects []BackupObject, dbName string) []storedBackup {
+	byKey := map[string]*storedBackup{}
+	var backups []*storedBackup
+	for _, obj := range objects {
+		if !strings.HasPrefix(path.Base(obj.Key), dbName+"_backup_") {
+			continue
+		}
+
+		key := strings.TrimSuffix(splitPartRe.ReplaceAllString(obj.Key, ""), ".manifest.json")
+		backup, ok := byKey[key]
+		if !ok {
+			backup = &storedBackup{Key: key}
+			byKey[key] = backup
+			backups = append(backups, backup)
+		}
+		backup.Objects = append(backup.Objects, obj)
+		if obj.LastModified.After(backup.Time) {
+			backup.Time = obj.LastModified
+		}
+	}
+
+	sorted := make([]storedBackup, 0, len(backups))
+	for _, backup := range backups {
+		sorted = append(sorted, *backup)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.After(sorted[j].Time)
+	})
+
+	return sorted
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyExpired(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2025, 1, 8, 12, 0, 0, 0, time.Local)
+	at := func(year int, month time.Month, day, hour int) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name    string
+		policy  retentionPolicy
+		backups []storedBackup
+		// expired are the indexes of the backups expected to expire.
+		expired []int
+	}{
+		{
+			name:   "days",
+			policy: retentionPolicy{Days: 7},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 2, 2), 100),
+				testBackup("", at(2025, 1, 1, 2), 100),
+				testBackup("", at(2024, 12, 20, 2), 100),
+			},
+			expired: []int{2, 3},
+		},
+		{
+			name:   "newest backup is kept however old",
+			policy: retentionPolicy{Days: 7},
+			backups: []storedBackup{
+				testBackup("", at(2024, 12, 1, 2), 100),
+				testBackup("", at(2024, 11, 30, 2), 100),
+			},
+			expired: []int{1},
+		},
+		{
+			name:   "min count",
+			policy: retentionPolicy{Days: 7, MinCount: 3},
+			backups: []storedBackup{
+				testBackup("", at(2024, 12, 4, 2), 100),
+				testBackup("", at(2024, 12, 3, 2), 100),
+				testBackup("", at(2024, 12, 2, 2), 100),
+				testBackup("", at(2024, 12, 1, 2), 100),
+			},
+			expired: []int{3},
+		},
+		{
+			name:   "count",
+			policy: retentionPolicy{Days: 7, Count: 2},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 7, 2), 100),
+				testBackup("", at(2025, 1, 6, 2), 100),
+				testBackup("", at(2025, 1, 5, 2), 100),
+			},
+			expired: []int{2, 3},
+		},
+		{
+			name:   "zero counts keep backups by days",
+			policy: retentionPolicy{Days: 2, Count: 0, Daily: 0},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 7, 2), 100),
+				testBackup("", at(2025, 1, 5, 2), 100),
+			},
+			expired: []int{2},
+		},
+		{
+			name:   "zero weekly count keeps no weeks",
+			policy: retentionPolicy{Days: 30, Daily: 2, Weekly: 0},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 7, 14), 100),
+				testBackup("", at(2025, 1, 7, 2), 100),
+				testBackup("", at(2025, 1, 6, 2), 100),
+			},
+			expired: []int{2, 3},
+		},
+		{
+			name:   "daily keeps the newest backup of each day",
+			policy: retentionPolicy{Daily: 3},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 7, 14), 100),
+				testBackup("", at(2025, 1, 7, 2), 100),
+				testBackup("", at(2025, 1, 5, 2), 100),
+				testBackup("", at(2025, 1, 4, 2), 100),
+			},
+			expired: []int{2, 4},
+		},
+		{
+			name:   "weekly splits weeks on Monday",
+			policy: retentionPolicy{Weekly: 2},
+			backups: []storedBackup{
+				// 2024-W01 starts on Monday, January 1st, 2024-W52 ends
+				// on Sunday, December 31st.
+				testBackup("", at(2024, 1, 1, 2), 100),
+				testBackup("", at(2023, 12, 31, 2), 100),
+				testBackup("", at(2023, 12, 25, 2), 100),
+				testBackup("", at(2023, 12, 24, 2), 100),
+			},
+			expired: []int{2, 3},
+		},
+		{
+			name:   "weekly uses the ISO year across new year",
+			policy: retentionPolicy{Weekly: 1},
+			backups: []storedBackup{
+				// Monday, December 30th, 2024 is in 2025-W01.
+				testBackup("", at(2025, 1, 2, 2), 100),
+				testBackup("", at(2024, 12, 30, 2), 100),
+				testBackup("", at(2024, 12, 29, 2), 100),
+			},
+			expired: []int{1, 2},
+		},
+		{
+			name:   "grandfather-father-son",
+			policy: retentionPolicy{Daily: 2, Weekly: 2, Monthly: 2},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 7, 2), 100),
+				testBackup("", at(2025, 1, 6, 2), 100),
+				testBackup("", at(2025, 1, 5, 2), 100),
+				testBackup("", at(2025, 1, 4, 2), 100),
+				testBackup("", at(2024, 12, 31, 2), 100),
+				testBackup("", at(2024, 11, 30, 2), 100),
+			},
+			// Kept: the last two days, the newest of 2025-W02 and
+			// 2025-W01, and of January and December.
+			expired: []int{2, 4, 6},
+		},
+		{
+			name:   "max size",
+			policy: retentionPolicy{Days: 30, MaxSize: 250},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 7, 2), 100),
+				testBackup("", at(2025, 1, 6, 2), 100),
+				testBackup("", at(2025, 1, 5, 2), 100),
+			},
+			expired: []int{2, 3},
+		},
+		{
+			name:   "max size keeps the min count",
+			policy: retentionPolicy{Days: 30, MaxSize: 250, MinCount: 3},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 7, 2), 100),
+				testBackup("", at(2025, 1, 6, 2), 100),
+				testBackup("", at(2025, 1, 5, 2), 100),
+			},
+			expired: []int{3},
+		},
+		{
+			name:   "max size keeps the newest backup if it is larger",
+			policy: retentionPolicy{Days: 30, MaxSize: 250},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 500),
+				testBackup("", at(2025, 1, 7, 2), 100),
+			},
+			expired: []int{1},
+		},
+		{
+			name:   "max size and days",
+			policy: retentionPolicy{Days: 2, MaxSize: 250},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 200),
+				testBackup("", at(2025, 1, 7, 2), 100),
+				testBackup("", at(2025, 1, 1, 2), 100),
+			},
+			expired: []int{1, 2},
+		},
+		{
+			name:   "tier days",
+			policy: retentionPolicy{Days: 30, TierDays: map[string]int{"hourly": 1}},
+			backups: []storedBackup{
+				testBackup("hourly", at(2025, 1, 8, 11), 100),
+				testBackup("hourly", at(2025, 1, 8, 2), 100),
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("hourly", at(2025, 1, 6, 11), 100),
+				testBackup("daily", at(2024, 12, 20, 2), 100),
+				testBackup("", at(2024, 12, 1, 2), 100),
+			},
+			// Tiers without days of their own are kept for Days.
+			expired: []int{3, 5},
+		},
+		{
+			name:   "tier days keep the newest backup of the tier",
+			policy: retentionPolicy{Days: 30, MinCount: 1, TierDays: map[string]int{"hourly": 1}},
+			backups: []storedBackup{
+				testBackup("", at(2025, 1, 8, 2), 100),
+				testBackup("hourly", at(2025, 1, 5, 11), 100),
+				testBackup("hourly", at(2025, 1, 5, 10), 100),
+			},
+			expired: []int{2},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, backup := range tt.policy.expired(tt.backups, now, logger) {
+				got = append(got, backup.Key)
+			}
+			var want []string
+			for _, i := range tt.expired {
+				want = append(want, tt.backups[i].Key)
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expired = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBackupTier(t *testing.T) {
+	tests := map[string]string{
+		"backups/app_backup_20250108_020000.sql.gz":        "",
+		"backups/app_backup_hourly_20250108_020000.sql.gz": "hourly",
+		"backups/my_app_backup_pre-deploy_20250108_020000": "pre-deploy",
+		"backups/app_latest.json":                          "",
+	}
+
+	for key, want := range tests {
+		if got := backupTier(key); got != want {
+			t.Errorf("backupTier(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// testBackup returns a backup of a single object taken at t, of tier if it
+// isn't empty.
+func testBackup(tier string, t time.Time, size int64) storedBackup {
+	stamp := t.Format("20060102_150405")
+	if tier != "" {
+		stamp = tier + "_" + stamp
+	}
+	key := "backups/app_backup_" + stamp + ".sql.gz"
+
+	return storedBackup{
+		Key:     key,
+		Time:    t,
+		Objects: []BackupObject{{Key: key, Size: size, LastModified: t}},
+	}
+}
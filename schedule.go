@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// runSchedule implements the schedule command, which prints the schedules of
+// every source block and their next runs, to check a cron expression and the
+// timezone before relying on them:
+//
+//	backup-app schedule 10
+func runSchedule(args []string) {
+	runs := 5
+	if len(args) > 1 {
+		fatalf("Usage: schedule [number of runs]")
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fatalf("Invalid number of runs %q (expected a positive number)", args[0])
+		}
+		runs = n
+	}
+
+	configs, err := loadConfigs()
+	if err != nil {
+		fatalf("Failed to load configuration: %v", err)
+	}
+
+	now := time.Now()
+	for _, cfg := range configs {
+		for _, schedule := range cfg.Schedules {
+			sched, err := cronParser.Parse(schedule.Spec)
+			if err != nil {
+				fatalf("Invalid schedule %q: %v", schedule.Spec, err)
+			}
+
+			label := "Backups"
+			if cfg.Block != "" {
+				label = "Backups of source block " + cfg.Block
+			}
+			if schedule.Tier != "" {
+				label += ", tier " + schedule.Tier
+			}
+			fmt.Printf("%s: %q in timezone %s\n", label, schedule.Spec, cfg.Location)
+
+			next := now.In(cfg.Location)
+			for i := 0; i < runs; i++ {
+				next = sched.Next(next)
+				fmt.Printf("  %s\n", next.Format("Mon 2006-01-02 15:04:05 MST"))
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Source is something backups are made of, such as an SQLite database file
+// or a PostgreSQL database. Implementations register themselves by name with
+// registerSource and are selected with the SOURCE_TYPE environment variable.
+type Source interface {
+	// Name identifies the backed up data in backup file names, keys and
+	// metadata.
+	Name() string
+	// Type is the name the source is registered under.
+	Type() string
+	// Extension is the file extension of the dump, before compression.
+	Extension() string
+	// Dump writes a backup to w.
+	Dump(ctx context.Context, w io.Writer) error
+}
+
+// MetadataProvider is implemented by sources and encryptors that can describe
+// their backups beyond the generic metadata, such as the schema version of a
+// database.
+type MetadataProvider interface {
+	Metadata() map[string]string
+}
+
+type sourceFactory func(cfg *Config) (Source, error)
+
+// sourceDiscoverer creates any number of sources, for source types that back
+// up several things at once, like every database matching a pattern.
+type sourceDiscoverer func(cfg *Config) ([]Source, error)
+
+var (
+	sources           = map[string]sourceFactory{}
+	sourceDiscoverers = map[string]sourceDiscoverer{}
+)
+
+func registerSource(name string, factory sourceFactory) {
+	sources[name] = factory
+}
+
+func registerSourceDiscoverer(name string, discoverer sourceDiscoverer) {
+	sourceDiscoverers[name] = discoverer
+}
+
+// newSources creates the sources for every type in SOURCE_TYPE. Sources are
+// created anew for every run, as what a discoverer finds, such as the
+// databases matching a DB_PATH glob pattern, can change.
+func newSources(cfg *Config) ([]Source, error) {
+	if len(cfg.SourceTypes) == 0 {
+		return nil, fmt.Errorf("no source configured")
+	}
+
+	var list []Source
+	for _, typ := range cfg.SourceTypes {
+		if discover, ok := sourceDiscoverers[typ]; ok {
+			found, err := discover(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", typ, err)
+			}
+			list = append(list, found...)
+			continue
+		}
+
+		source, err := newSource(typ, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", typ, err)
+		}
+		list = append(list, source)
+	}
+
+	if len(list) > 1 && cfg.SourceName != "" {
+		return nil, fmt.Errorf("SOURCE_NAME can only be used with a single source")
+	}
+
+	// Sources are told apart by name in backup file names and keys.
+	seen := map[string]bool{}
+	for _, source := range list {
+		if seen[source.Name()] {
+			return nil, fmt.Errorf("several sources are named %q", source.Name())
+		}
+		seen[source.Name()] = true
+	}
+
+	return list, nil
+}
+
+func newSource(typ string, cfg *Config) (Source, error) {
+	factory, ok := sources[typ]
+	if !ok {
+		names := make([]string, 0, len(sources)+len(sourceDiscoverers))
+		for name := range sources {
+			names = append(names, name)
+		}
+		for name := range sourceDiscoverers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown source type %q (available: %s)", typ, strings.Join(names, ", "))
+	}
+
+	return factory(cfg)
+}
+
+// runDump runs a dump tool that writes its backup to stdout, copying the
+// output to w. The returned error includes what the tool wrote to stderr.
+func runDump(cmd *exec.Cmd, w io.Writer) error {
+	var stderr bytes.Buffer
+
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", filepath.Base(cmd.Path), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// dumpCommand runs a dump tool, either locally or, with
+// DOCKER_EXEC_CONTAINER, inside another container through docker exec, so
+// the tool doesn't need to be installed in this one.
+type dumpCommand struct {
+	binary    string
+	docker    *dockerClient
+	container string
+}
+
+// newDumpCommand looks up binary, the configured path of tool. Inside another
+// container it is looked up on the PATH of that container when run.
+func newDumpCommand(cfg *Config, tool, binary string) (*dumpCommand, error) {
+	if cfg.DockerExecContainer != "" {
+		client, err := newDockerClient(cfg.DockerHost)
+		if err != nil {
+			return nil, err
+		}
+		return &dumpCommand{binary: binary, docker: client, container: cfg.DockerExecContainer}, nil
+	}
+
+	p, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("%s binary not found: %w", tool, err)
+	}
+
+	return &dumpCommand{binary: p}, nil
+}
+
+// run runs the tool with args, adding the environment variables in env, and
+// copies its output to w.
+func (c *dumpCommand) run(ctx context.Context, args, env []string, w io.Writer) error {
+	if c.docker != nil {
+		if err := c.docker.exec(ctx, c.container, append([]string{c.binary}, args...), env, w); err != nil {
+			return fmt.Errorf("%s in container %s failed: %w", path.Base(c.binary), c.container, err)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, c.binary, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	return runDump(cmd, w)
+}
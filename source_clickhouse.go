@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSource("clickhouse", newClickHouseSource)
+}
+
+// clickhouseSource backs up ClickHouse databases over the HTTP interface, so
+// neither clickhouse-client nor access to the server's disks is needed. The
+// backup is a tar archive with the CREATE statement of every table in
+// <database>/<table>.sql and the data of tables that store it in
+// <database>/<table>.native, in ClickHouse's Native format.
+//
+// Tables are exported one after the other, so the backup is only consistent
+// per table, like with clickhouse-backup.
+type clickhouseSource struct {
+	name      string
+	endpoint  string
+	user      string
+	password  string
+	databases []string
+	tempDir   string
+	client    *http.Client
+}
+
+// clickhouseTable is a row of system.tables.
+type clickhouseTable struct {
+	Database string `json:"database"`
+	Name     string `json:"name"`
+	Engine   string `json:"engine"`
+	Create   string `json:"create_table_query"`
+}
+
+func newClickHouseSource(cfg *Config) (Source, error) {
+	if err := checkRequired(map[string]string{"CLICKHOUSE_URL": cfg.ClickHouseURL}); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(cfg.ClickHouseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CLICKHOUSE_URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid CLICKHOUSE_URL: unsupported scheme %q (expected http or https)", u.Scheme)
+	}
+
+	databases := splitList(cfg.ClickHouseDatabase)
+	if db := strings.Trim(u.Path, "/"); len(databases) == 0 && db != "" {
+		databases = []string{db}
+	}
+
+	name := cfg.SourceName
+	if name == "" && len(databases) == 1 {
+		name = databases[0]
+	}
+	if name == "" {
+		name = "clickhouse"
+	}
+
+	password, _ := u.User.Password()
+
+	return &clickhouseSource{
+		name:      name,
+		endpoint:  u.Scheme + "://" + u.Host + "/",
+		user:      u.User.Username(),
+		password:  password,
+		databases: databases,
+		tempDir:   cfg.BackupDir,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *clickhouseSource) Name() string { return s.name }
+
+func (s *clickhouseSource) Type() string { return "clickhouse" }
+
+func (s *clickhouseSource) Extension() string { return ".tar" }
+
+func (s *clickhouseSource) Dump(ctx context.Context, w io.Writer) error {
+	tables, err := s.tables(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, t := range tables {
+		dir := t.Database + "/"
+		create := []byte(t.Create + ";\n")
+		hdr := &tar.Header{Name: dir + t.Name + ".sql", Mode: 0644, Size: int64(len(create)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to archive table %s.%s: %w", t.Database, t.Name, err)
+		}
+		if _, err := tw.Write(create); err != nil {
+			return fmt.Errorf("failed to archive table %s.%s: %w", t.Database, t.Name, err)
+		}
+
+		if !clickhouseStoresData(t.Engine) {
+			continue
+		}
+		if err := s.exportTable(ctx, tw, t, dir+t.Name+".native", now); err != nil {
+			return fmt.Errorf("failed to export table %s.%s: %w", t.Database, t.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+
+	return nil
+}
+
+// tables lists the tables of the configured databases, or of every database
+// but the system ones if none is configured.
+func (s *clickhouseSource) tables(ctx context.Context) ([]clickhouseTable, error) {
+	query := "SELECT database, name, engine, create_table_query FROM system.tables WHERE NOT is_temporary"
+	if len(s.databases) > 0 {
+		quoted := make([]string, len(s.databases))
+		for i, db := range s.databases {
+			quoted[i] = clickhouseQuote(db)
+		}
+		query += " AND database IN (" + strings.Join(quoted, ", ") + ")"
+	} else {
+		query += " AND database NOT IN ('system', 'information_schema', 'INFORMATION_SCHEMA')"
+	}
+	query += " ORDER BY database, name FORMAT JSONEachRow"
+
+	body, err := s.query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	defer body.Close()
+
+	var tables []clickhouseTable
+	scanner := bufio.NewScanner(body)
+	// CREATE statements of wide tables can be long.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var t clickhouseTable
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			return nil, fmt.Errorf("failed to decode table list: %w", err)
+		}
+		tables = append(tables, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	return tables, nil
+}
+
+// exportTable writes the data of t to tw as name. The size of a tar entry
+// must be known up front, so the export is spooled to a temporary file first.
+func (s *clickhouseSource) exportTable(ctx context.Context, tw *tar.Writer, t clickhouseTable, name string, modTime time.Time) error {
+	body, err := s.query(ctx, "SELECT * FROM "+clickhouseIdent(t.Database)+"."+clickhouseIdent(t.Name)+" FORMAT Native")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp(s.tempDir, "clickhouse-*.native")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, tmp)
+	return err
+}
+
+// query runs query and returns the response body, which the caller must
+// close.
+//
+// ClickHouse sends the status before it streams the result, and an error in
+// the middle of the result is only appended to the body, where it would end
+// up in the backup as data. With wait_end_of_query, the server buffers the
+// whole result first, so every error is reported with the status.
+func (s *clickhouseSource) query(ctx context.Context, query string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"?wait_end_of_query=1", strings.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to ClickHouse failed: %w", err)
+	}
+	if code := resp.Header.Get("X-ClickHouse-Exception-Code"); resp.StatusCode != http.StatusOK || code != "" {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("ClickHouse error %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	return resp.Body, nil
+}
+
+// clickhouseStoresData reports whether tables with engine hold data of their
+// own. Views, dictionaries and tables of integration engines like Kafka or
+// Distributed only point elsewhere.
+func clickhouseStoresData(engine string) bool {
+	switch engine {
+	case "Log", "TinyLog", "StripeLog", "Memory":
+		return true
+	}
+
+	return strings.HasSuffix(engine, "MergeTree")
+}
+
+// clickhouseIdent quotes an identifier for use in a query.
+func clickhouseIdent(name string) string {
+	return "`" + strings.ReplaceAll(strings.ReplaceAll(name, `\`, `\\`), "`", "\\`") + "`"
+}
+
+// clickhouseQuote quotes a string literal for use in a query.
+func clickhouseQuote(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", `\'`) + "'"
+}
+
+// Metadata records which databases the backup contains.
+func (s *clickhouseSource) Metadata() map[string]string {
+	if len(s.databases) == 0 {
+		return nil
+	}
+
+	return map[string]string{"databases": strings.Join(s.databases, ",")}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSource("couchdb", newCouchDBSource)
+}
+
+// couchDBPageSize is how many documents are fetched per request.
+const couchDBPageSize = 1000
+
+// couchDBSource backs up CouchDB databases through _all_docs. The backup is a
+// tar archive with a <database>.json file per database, holding all documents
+// with their attachments in the format _bulk_docs expects, so a database is
+// restored by posting the file to _bulk_docs with new_edits set to false,
+// which keeps the revisions.
+type couchDBSource struct {
+	name      string
+	endpoint  string
+	user      string
+	password  string
+	databases []string
+	tempDir   string
+	client    *http.Client
+}
+
+func newCouchDBSource(cfg *Config) (Source, error) {
+	if err := checkRequired(map[string]string{"COUCHDB_URL": cfg.CouchDBURL}); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(cfg.CouchDBURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid COUCHDB_URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid COUCHDB_URL: unsupported scheme %q (expected http or https)", u.Scheme)
+	}
+
+	databases := splitList(cfg.CouchDBDatabases)
+
+	name := cfg.SourceName
+	if name == "" && len(databases) == 1 {
+		name = databases[0]
+	}
+	if name == "" {
+		name = "couchdb"
+	}
+
+	password, _ := u.User.Password()
+
+	return &couchDBSource{
+		name:      name,
+		endpoint:  u.Scheme + "://" + u.Host,
+		user:      u.User.Username(),
+		password:  password,
+		databases: databases,
+		tempDir:   cfg.BackupDir,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *couchDBSource) Name() string { return s.name }
+
+func (s *couchDBSource) Type() string { return "couchdb" }
+
+func (s *couchDBSource) Extension() string { return ".tar" }
+
+func (s *couchDBSource) Dump(ctx context.Context, w io.Writer) error {
+	databases := s.databases
+	if len(databases) == 0 {
+		var err error
+		if databases, err = s.allDatabases(ctx); err != nil {
+			return err
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, db := range databases {
+		if err := s.exportDatabase(ctx, tw, db); err != nil {
+			return fmt.Errorf("failed to export database %s: %w", db, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+
+	return nil
+}
+
+// allDatabases lists the databases on the server, without system databases
+// like _users and _replicator.
+func (s *couchDBSource) allDatabases(ctx context.Context) ([]string, error) {
+	var all []string
+	if err := s.getJSON(ctx, "/_all_dbs", nil, &all); err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+
+	var databases []string
+	for _, db := range all {
+		if !strings.HasPrefix(db, "_") {
+			databases = append(databases, db)
+		}
+	}
+
+	return databases, nil
+}
+
+// exportDatabase writes the documents of db to tw. The size of a tar entry
+// must be known up front, so the export is spooled to a temporary file first.
+func (s *couchDBSource) exportDatabase(ctx context.Context, tw *tar.Writer, db string) error {
+	tmp, err := os.CreateTemp(s.tempDir, "couchdb-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	bw := bufio.NewWriter(tmp)
+	bw.WriteString(`{"docs":[`)
+
+	// Documents are paged through by ID, every page starts after the last
+	// document of the previous one.
+	query := url.Values{
+		"include_docs": {"true"},
+		"attachments":  {"true"},
+		"limit":        {strconv.Itoa(couchDBPageSize)},
+	}
+	count := 0
+	for {
+		var page struct {
+			Rows []struct {
+				ID  string          `json:"id"`
+				Doc json.RawMessage `json:"doc"`
+			} `json:"rows"`
+		}
+		if err := s.getJSON(ctx, "/"+url.PathEscape(db)+"/_all_docs", query, &page); err != nil {
+			return err
+		}
+
+		for _, row := range page.Rows {
+			if count > 0 {
+				bw.WriteString(",\n")
+			}
+			bw.Write(row.Doc)
+			count++
+		}
+
+		if len(page.Rows) < couchDBPageSize {
+			break
+		}
+		startKey, err := json.Marshal(page.Rows[len(page.Rows)-1].ID)
+		if err != nil {
+			return err
+		}
+		query.Set("start_key", string(startKey))
+		query.Set("skip", "1")
+	}
+
+	bw.WriteString("]}\n")
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: db + ".json", Mode: 0644, Size: info.Size(), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, tmp)
+	return err
+}
+
+// getJSON sends a GET request for path and decodes the JSON response into v.
+func (s *couchDBSource) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	u := s.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to CouchDB failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("CouchDB error %d: %s: %s", resp.StatusCode, apiErr.Error, apiErr.Reason)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Metadata records which databases the backup contains.
+func (s *couchDBSource) Metadata() map[string]string {
+	if len(s.databases) == 0 {
+		return nil
+	}
+
+	return map[string]string{"databases": strings.Join(s.databases, ",")}
+}
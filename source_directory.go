@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerSource("directory", newDirectorySource)
+}
+
+// directorySource backs up a directory tree, such as an uploads or config
+// directory, as a tar archive.
+type directorySource struct {
+	name       string
+	root       string
+	include    []string
+	exclude    []string
+	ignoreFile string
+}
+
+func newDirectorySource(cfg *Config) (Source, error) {
+	if err := checkRequired(map[string]string{"DIR_PATH": cfg.DirPath}); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(cfg.DirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access DIR_PATH: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("DIR_PATH %s is not a directory", cfg.DirPath)
+	}
+
+	name := cfg.SourceName
+	if name == "" {
+		name = filepath.Base(filepath.Clean(cfg.DirPath))
+	}
+
+	return &directorySource{
+		name:       name,
+		root:       cfg.DirPath,
+		include:    splitList(cfg.DirInclude),
+		exclude:    splitList(cfg.DirExclude),
+		ignoreFile: cfg.DirIgnoreFile,
+	}, nil
+}
+
+func (s *directorySource) Name() string { return s.name }
+
+func (s *directorySource) Type() string { return "directory" }
+
+func (s *directorySource) Extension() string { return ".tar" }
+
+func (s *directorySource) Dump(ctx context.Context, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	var ignore ignoreRules
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." && (matchesAny(s.exclude, rel) || ignore.excluded(rel, d.IsDir())) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// The ignore file of a directory applies to everything below it.
+		if d.IsDir() && s.ignoreFile != "" {
+			base := rel
+			if base == "." {
+				base = ""
+			}
+			if ignore, err = ignore.loadIgnoreFile(p, base, s.ignoreFile); err != nil {
+				return err
+			}
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		if d.IsDir() {
+			// Directories are only stored when everything is included, to
+			// keep empty ones. Otherwise they are created on extraction as
+			// needed.
+			if len(s.include) > 0 {
+				return nil
+			}
+		} else if len(s.include) > 0 && !matchesAny(s.include, rel) {
+			return nil
+		}
+
+		return addToTar(tw, p, rel, d)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", s.root, err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", s.root, err)
+	}
+
+	return nil
+}
+
+// addToTar writes a directory, regular file or symlink to tw under the name
+// rel. Other file types, such as sockets, are skipped.
+func addToTar(tw *tar.Writer, p, rel string, d fs.DirEntry) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	var link string
+	switch {
+	case info.Mode().IsRegular(), info.IsDir():
+	case info.Mode()&fs.ModeSymlink != 0:
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Only copy as much as the header announced, files that are appended to
+	// while being archived would corrupt the archive otherwise.
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// matchesAny reports whether the slash separated relative path rel matches
+// one of the patterns. Patterns without a slash, like *.log or node_modules,
+// are matched against every path element, so they apply at any depth.
+// Patterns with a slash, like uploads/tmp or cache/*, are matched against the
+// path from the root of the backup and match everything below a matching
+// directory.
+func matchesAny(patterns []string, rel string) bool {
+	elems := strings.Split(rel, "/")
+
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		if !strings.Contains(pattern, "/") {
+			for _, elem := range elems {
+				if ok, _ := path.Match(pattern, elem); ok {
+					return true
+				}
+			}
+			continue
+		}
+
+		for i := range elems {
+			if ok, _ := path.Match(pattern, strings.Join(elems[:i+1], "/")); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
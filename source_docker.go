@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+)
+
+func init() {
+	registerSourceDiscoverer("docker", discoverDockerSources)
+}
+
+// dockerSource backs up a path inside a running container, found through its
+// labels. The path is copied out through the Docker API as a tar archive, so
+// it doesn't need to be mounted into this container. SQLite databases are
+// copied with the sqlite3 shell inside the container instead, as a raw copy
+// of a database that is written to can be torn and miss its WAL.
+type dockerSource struct {
+	name           string
+	client         *dockerClient
+	container      string
+	containerName  string
+	path           string
+	sqlite         bool
+	integrityCheck string
+	mode           string
+}
+
+// discoverDockerSources creates a source for every running container labeled
+// <prefix>.enabled=true, backing up the path in its <prefix>.path label, as
+// told by its <prefix>.type label.
+func discoverDockerSources(cfg *Config) ([]Source, error) {
+	client, err := newDockerClient(cfg.DockerHost)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := cfg.DockerLabelPrefix
+	containers, err := client.listContainers(context.Background(), prefix+".enabled=true")
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover containers: %w", err)
+	}
+
+	var list []Source
+	for _, c := range containers {
+		p := c.Labels[prefix+".path"]
+		if p == "" {
+			slog.Warn("Skipping container: "+prefix+".path label is not set", "job", "backup", "container", c.Name())
+			continue
+		}
+
+		name := c.Labels[prefix+".name"]
+		if name == "" {
+			name = c.Name()
+		}
+
+		// Paths named like SQLite databases are backed up as one, unless
+		// labeled as files.
+		var sqlite bool
+		switch typ := c.Labels[prefix+".type"]; typ {
+		case "":
+			sqlite = isSQLitePath(p)
+		case "files":
+		case "sqlite":
+			sqlite = true
+		default:
+			slog.Warn("Skipping container: invalid "+prefix+".type label (expected files or sqlite)", "job", "backup", "container", c.Name(), "type", typ)
+			continue
+		}
+
+		list = append(list, &dockerSource{
+			name:           name,
+			client:         client,
+			container:      c.ID,
+			containerName:  c.Name(),
+			path:           p,
+			sqlite:         sqlite,
+			integrityCheck: cfg.IntegrityCheck,
+			mode:           cfg.BackupMode,
+		})
+	}
+
+	if len(list) == 0 {
+		slog.Info("No containers labeled "+prefix+".enabled=true found", "job", "backup")
+	}
+
+	return list, nil
+}
+
+func (s *dockerSource) Name() string { return s.name }
+
+func (s *dockerSource) Type() string { return "docker" }
+
+// Extension is .sql for SQLite databases, like the backups of the sqlite
+// source.
+func (s *dockerSource) Extension() string {
+	if s.sqlite {
+		return ".sql"
+	}
+
+	return ".tar"
+}
+
+func (s *dockerSource) Dump(ctx context.Context, w io.Writer) error {
+	if s.sqlite {
+		if err := s.client.exec(ctx, s.container, append([]string{"sh"}, sqliteContainerArgs(s.path, s.integrityCheck, s.mode)...), nil, w); err != nil {
+			return fmt.Errorf("failed to back up %s in container %s: %w", s.path, s.name, err)
+		}
+		return nil
+	}
+
+	archive, err := s.client.archive(ctx, s.container, s.path)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s from container %s: %w", s.path, s.name, err)
+	}
+	defer archive.Close()
+
+	if _, err := io.Copy(w, archive); err != nil {
+		return fmt.Errorf("failed to copy %s from container %s: %w", s.path, s.name, err)
+	}
+
+	return nil
+}
+
+// isSQLitePath reports whether p is named like an SQLite database.
+func isSQLitePath(p string) bool {
+	switch path.Ext(p) {
+	case ".db", ".sqlite", ".sqlite3":
+		return true
+	}
+
+	return false
+}
+
+// Metadata records which container and path the backup was copied from.
+func (s *dockerSource) Metadata() map[string]string {
+	return map[string]string{
+		"container": s.containerName,
+		"path":      s.path,
+	}
+}
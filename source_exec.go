@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+func init() {
+	registerSource("exec", newExecSource)
+}
+
+// execSource backs up whatever a user provided command writes to stdout, for
+// databases and tools there is no dedicated source for. The command is run
+// with sh -c, so it can be a pipeline.
+type execSource struct {
+	name      string
+	cmd       *dumpCommand
+	command   string
+	extension string
+}
+
+func newExecSource(cfg *Config) (Source, error) {
+	if err := checkRequired(map[string]string{"EXEC_COMMAND": cfg.ExecCommand}); err != nil {
+		return nil, err
+	}
+
+	cmd, err := newDumpCommand(cfg, "sh", "sh")
+	if err != nil {
+		return nil, err
+	}
+
+	name := cfg.SourceName
+	if name == "" {
+		name = "exec"
+	}
+
+	return &execSource{
+		name:      name,
+		cmd:       cmd,
+		command:   cfg.ExecCommand,
+		extension: cfg.ExecExtension,
+	}, nil
+}
+
+func (s *execSource) Name() string { return s.name }
+
+func (s *execSource) Type() string { return "exec" }
+
+func (s *execSource) Extension() string { return s.extension }
+
+func (s *execSource) Dump(ctx context.Context, w io.Writer) error {
+	return s.cmd.run(ctx, []string{"-c", s.command}, nil, w)
+}
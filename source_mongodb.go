@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+func init() {
+	registerSource("mongodb", newMongoDBSource)
+}
+
+// mongoDBSource backs up a MongoDB deployment with mongodump, which writes a
+// single archive to stdout with --archive. The archive is restored with
+// mongorestore --archive.
+type mongoDBSource struct {
+	name      string
+	cmd       *dumpCommand
+	uri       string
+	password  string
+	database  string
+	tempDir   string
+	extraArgs []string
+}
+
+// mongoDumpContainerScript runs mongodump $1 inside another container with
+// the arguments after it and the configuration file in $MONGODUMP_CONFIG,
+// which is written to a file only readable by its owner first.
+const mongoDumpContainerScript = `set -e
+umask 077
+config=$(mktemp)
+trap 'rm -f "$config"' EXIT
+printf '%s\n' "$MONGODUMP_CONFIG" > "$config"
+binary=$1
+shift
+"$binary" --config="$config" "$@"
+`
+
+func newMongoDBSource(cfg *Config) (Source, error) {
+	if err := checkRequired(map[string]string{"MONGODB_URI": cfg.MongoDBURI}); err != nil {
+		return nil, err
+	}
+
+	cmd, err := newDumpCommand(cfg, "mongodump", cfg.MongoDumpBinary)
+	if err != nil {
+		return nil, err
+	}
+
+	// The database in the URI is often only the one to authenticate
+	// against, like admin, so it only names the backup.
+	name := cfg.SourceName
+	if name == "" {
+		name = cfg.MongoDBDatabase
+	}
+	if name == "" {
+		name = mongoDBDatabaseName(cfg.MongoDBURI)
+	}
+	if name == "" {
+		name = "mongodb"
+	}
+
+	uri, password := mongoDBStripPassword(cfg.MongoDBURI)
+
+	return &mongoDBSource{
+		name:      name,
+		cmd:       cmd,
+		uri:       uri,
+		password:  password,
+		database:  cfg.MongoDBDatabase,
+		tempDir:   cfg.BackupDir,
+		extraArgs: strings.Fields(cfg.MongoDumpExtraArgs),
+	}, nil
+}
+
+func (s *mongoDBSource) Name() string { return s.name }
+
+func (s *mongoDBSource) Type() string { return "mongodb" }
+
+func (s *mongoDBSource) Extension() string { return ".archive" }
+
+func (s *mongoDBSource) Dump(ctx context.Context, w io.Writer) error {
+	args := []string{"--uri=" + s.uri, "--archive", "--quiet"}
+	// Without a database every database of the deployment is dumped.
+	if s.database != "" {
+		args = append(args, "--db="+s.database)
+	}
+	args = append(args, s.extraArgs...)
+
+	if s.password == "" {
+		return s.cmd.run(ctx, args, nil, w)
+	}
+
+	// The password is passed in a configuration file rather than on the
+	// command line, where other processes could read it.
+	config := "password: '" + strings.ReplaceAll(s.password, "'", "''") + "'"
+	if s.cmd.docker != nil {
+		sh := *s.cmd
+		sh.binary = "sh"
+		args = append([]string{"-c", mongoDumpContainerScript, "sh", s.cmd.binary}, args...)
+		return sh.run(ctx, args, []string{"MONGODUMP_CONFIG=" + config}, w)
+	}
+
+	// Temporary files are only readable by their owner.
+	f, err := os.CreateTemp(s.tempDir, "mongodump-*.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to create mongodump configuration: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(config + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write mongodump configuration: %w", err)
+	}
+
+	return s.cmd.run(ctx, append([]string{"--config=" + f.Name()}, args...), nil, w)
+}
+
+// mongoDBStripPassword removes the password from a connection string and
+// returns the connection string without it and the password.
+func mongoDBStripPassword(uri string) (string, string) {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri, ""
+	}
+	password, ok := u.User.Password()
+	if !ok || password == "" {
+		return uri, ""
+	}
+	u.User = url.User(u.User.Username())
+
+	return u.String(), password
+}
+
+// mongoDBDatabaseName returns the database from the path of a connection
+// string (mongodb://host/dbname), if any.
+func mongoDBDatabaseName(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(u.Path, "/")
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSource("redis", newRedisSource)
+}
+
+const (
+	redisDialTimeout = 30 * time.Second
+	// How often the progress of a BGSAVE is checked.
+	redisPollInterval = time.Second
+)
+
+// redisSource backs up a Redis server as an RDB snapshot. By default the
+// snapshot is requested over the wire like a replica does (the same as
+// redis-cli --rdb), which needs no access to the server's files. Managed
+// services often disable SYNC though; with REDIS_RDB_FILE set, the server is
+// told to BGSAVE instead and the dump file is read from a shared volume.
+type redisSource struct {
+	name     string
+	addr     string
+	user     string
+	password string
+	tls      bool
+	rdbFile  string
+}
+
+func newRedisSource(cfg *Config) (Source, error) {
+	if err := checkRequired(map[string]string{"REDIS_URL": cfg.RedisURL}); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid REDIS_URL: unsupported scheme %q (expected redis or rediss)", u.Scheme)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+
+	name := cfg.SourceName
+	if name == "" {
+		name = "redis"
+	}
+
+	s := &redisSource{
+		name:    name,
+		addr:    net.JoinHostPort(u.Hostname(), port),
+		user:    u.User.Username(),
+		tls:     u.Scheme == "rediss",
+		rdbFile: cfg.RedisRDBFile,
+	}
+	s.password, _ = u.User.Password()
+
+	return s, nil
+}
+
+func (s *redisSource) Name() string { return s.name }
+
+func (s *redisSource) Type() string { return "redis" }
+
+func (s *redisSource) Extension() string { return ".rdb" }
+
+func (s *redisSource) Dump(ctx context.Context, w io.Writer) error {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock reads and writes when the context is cancelled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if s.rdbFile != "" {
+		err = s.dumpBGSave(ctx, conn, w)
+	} else {
+		err = s.dumpSync(conn, w)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// dumpSync asks the server for a full resynchronization, which it answers
+// with an RDB snapshot before streaming the replication feed. Only the
+// snapshot is read.
+func (s *redisSource) dumpSync(conn *redisConn, w io.Writer) error {
+	if err := conn.send("SYNC"); err != nil {
+		return err
+	}
+
+	for {
+		b, err := conn.r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("failed to read Redis snapshot: %w", err)
+		}
+
+		switch b {
+		case '\n':
+			// Keepalives sent while the server is still saving the snapshot.
+			continue
+		case '-':
+			line, _ := conn.readLine()
+			return fmt.Errorf("redis SYNC failed: %s", line)
+		case '$':
+			line, err := conn.readLine()
+			if err != nil {
+				return fmt.Errorf("failed to read Redis snapshot: %w", err)
+			}
+			size, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected Redis snapshot header %q", line)
+			}
+			if _, err := io.CopyN(w, conn.r, size); err != nil {
+				return fmt.Errorf("failed to read Redis snapshot: %w", err)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unexpected Redis reply to SYNC: %q", b)
+		}
+	}
+}
+
+// dumpBGSave triggers a background save, waits for it to finish and copies
+// the dump file the server wrote.
+func (s *redisSource) dumpBGSave(ctx context.Context, conn *redisConn, w io.Writer) error {
+	lastSave, err := conn.do("LASTSAVE")
+	if err != nil {
+		return err
+	}
+
+	// A save that is already running is waited for just the same.
+	if _, err := conn.do("BGSAVE"); err != nil && !strings.Contains(err.Error(), "already in progress") {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(redisPollInterval):
+		}
+
+		save, err := conn.do("LASTSAVE")
+		if err != nil {
+			return err
+		}
+		if save != lastSave {
+			break
+		}
+
+		// LASTSAVE only changes on success, stop waiting once the save
+		// failed.
+		info, err := conn.do("INFO", "persistence")
+		if err != nil {
+			return err
+		}
+		if strings.Contains(info, "rdb_bgsave_in_progress:0") && strings.Contains(info, "rdb_last_bgsave_status:err") {
+			return fmt.Errorf("redis BGSAVE failed, see the Redis log for details")
+		}
+	}
+
+	f, err := os.Open(s.rdbFile)
+	if err != nil {
+		return fmt.Errorf("failed to open Redis dump file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to copy Redis dump file: %w", err)
+	}
+
+	return nil
+}
+
+// redisConn is a minimal client for the Redis protocol (RESP), enough to
+// authenticate and issue the few commands a backup needs.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (s *redisSource) connect(ctx context.Context) (*redisConn, error) {
+	var conn net.Conn
+	var err error
+	if s.tls {
+		host, _, _ := net.SplitHostPort(s.addr)
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: redisDialTimeout}, Config: &tls.Config{ServerName: host}}
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	} else {
+		dialer := &net.Dialer{Timeout: redisDialTimeout}
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.user != "" {
+			args = []string{"AUTH", s.user, s.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to authenticate with Redis: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *redisConn) send(args ...string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := io.WriteString(c, sb.String())
+	return err
+}
+
+// do sends a command and returns its reply. Only simple strings, errors,
+// integers and bulk strings are supported, which covers every command used
+// here.
+func (c *redisConn) do(args ...string) (string, error) {
+	if err := c.send(args...); err != nil {
+		return "", err
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return "", err
+	}
+	if line == "" {
+		return "", errors.New("empty reply from Redis")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("redis %s failed: %s", args[0], line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return "", nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:size]), nil
+	default:
+		return "", fmt.Errorf("unexpected reply to redis %s: %q", args[0], line)
+	}
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
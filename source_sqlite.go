@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerSourceDiscoverer("sqlite", newSQLiteSources)
+}
+
+// sqliteSource backs up an SQLite database file. The database is first
+// copied into a temporary file in BACKUP_DIR, as both the backup API and
+// VACUUM INTO need a file to write to.
+type sqliteSource struct {
+	name           string
+	dbPath         string
+	tempDir        string
+	mode           string
+	walCheckpoint  bool
+	integrityCheck string
+	// cmd runs the sqlite3 shell inside another container, when the database
+	// lives there rather than in a mounted volume.
+	cmd *dumpCommand
+}
+
+// sqliteContainerScript copies the database $1 inside another container with
+// the sqlite3 shell and writes the copy to stdout. $2 is the integrity check
+// pragma to run first, if any, and $3 the backup mode. Like local backups,
+// the copy is converted back to a single self-contained file.
+const sqliteContainerScript = `set -e
+tmp=$(mktemp)
+trap 'rm -f "$tmp"' EXIT
+if [ -n "$2" ]; then
+	result=$(sqlite3 "$1" ".timeout 30000" "PRAGMA $2(10);")
+	if [ "$result" != ok ]; then
+		echo "database $1 is corrupt: $result" >&2
+		exit 1
+	fi
+fi
+if [ "$3" = vacuum ]; then
+	sqlite3 "$1" ".timeout 30000" "VACUUM INTO '$tmp';"
+else
+	sqlite3 "$1" ".timeout 30000" ".backup '$tmp'"
+fi
+sqlite3 "$tmp" "PRAGMA journal_mode=DELETE;" >/dev/null
+cat "$tmp"
+`
+
+// sqliteContainerArgs returns the arguments of sh to run
+// sqliteContainerScript on the database at dbPath.
+func sqliteContainerArgs(dbPath, integrityCheck, mode string) []string {
+	pragma := ""
+	switch integrityCheck {
+	case "quick":
+		pragma = "quick_check"
+	case "full":
+		pragma = "integrity_check"
+	}
+
+	return []string{"-c", sqliteContainerScript, "sh", dbPath, pragma, mode}
+}
+
+// sqliteConfigs returns a copy of cfg for every database in DB_PATH, which
+// can list several databases separated by commas. HOST_DB_PATH, if set, must
+// list the same number of paths. Paths can be glob patterns, which are
+// evaluated anew for every run so databases added later are picked up.
+func sqliteConfigs(cfg *Config) ([]*Config, error) {
+	if err := checkRequired(map[string]string{"DB_PATH": cfg.DBPath}); err != nil {
+		return nil, err
+	}
+
+	var dbPaths []string
+	globbed := false
+	for _, pattern := range splitList(cfg.DBPath) {
+		if !strings.ContainsAny(pattern, "*?[") {
+			dbPaths = append(dbPaths, pattern)
+			continue
+		}
+
+		// The files are only visible inside the other container.
+		if cfg.DockerExecContainer != "" {
+			return nil, fmt.Errorf("glob patterns in DB_PATH can't be used with DOCKER_EXEC_CONTAINER")
+		}
+
+		globbed = true
+		matches, err := globSQLite(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			slog.Info("No databases match the pattern", "job", "backup", "path", pattern)
+		}
+		dbPaths = append(dbPaths, matches...)
+	}
+
+	hostPaths := splitList(cfg.HostDBPath)
+	if globbed && len(hostPaths) > 0 {
+		return nil, fmt.Errorf("HOST_DB_PATH can't be used with glob patterns in DB_PATH")
+	}
+	if len(hostPaths) > 0 && len(hostPaths) != len(dbPaths) {
+		return nil, fmt.Errorf("HOST_DB_PATH must list as many paths as DB_PATH")
+	}
+
+	configs := make([]*Config, len(dbPaths))
+	for i, dbPath := range dbPaths {
+		c := *cfg
+		c.DBPath = dbPath
+		c.HostDBPath = ""
+		if len(hostPaths) > 0 {
+			c.HostDBPath = hostPaths[i]
+		}
+		configs[i] = &c
+	}
+
+	return configs, nil
+}
+
+// newSQLiteSources creates a source for every database in DB_PATH.
+func newSQLiteSources(cfg *Config) ([]Source, error) {
+	configs, err := sqliteConfigs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Source, 0, len(configs))
+	for _, c := range configs {
+		source, err := newSQLiteSource(c)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, source)
+	}
+
+	return list, nil
+}
+
+// globSQLite returns the SQLite databases matching pattern. Other files, such
+// as the -wal and -shm files next to a database, are skipped.
+func globSQLite(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_PATH pattern %q: %w", pattern, err)
+	}
+
+	var dbPaths []string
+	for _, match := range matches {
+		if _, ok := sqliteHeader(match); ok {
+			dbPaths = append(dbPaths, match)
+		}
+	}
+
+	return dbPaths, nil
+}
+
+func newSQLiteSource(cfg *Config) (Source, error) {
+	if err := checkRequired(map[string]string{"DB_PATH": cfg.DBPath}); err != nil {
+		return nil, err
+	}
+
+	// Extract database name from HOST_DB_PATH, falling back to DB_PATH
+	name := cfg.HostDBPath
+	if name == "" {
+		name = cfg.DBPath
+	}
+	name = filepath.Base(name)
+	// Remove the extension if present
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if cfg.SourceName != "" {
+		name = cfg.SourceName
+	}
+
+	var cmd *dumpCommand
+	if cfg.DockerExecContainer != "" {
+		var err error
+		if cmd, err = newDumpCommand(cfg, "sh", "sh"); err != nil {
+			return nil, err
+		}
+	}
+
+	return &sqliteSource{
+		name:           name,
+		dbPath:         cfg.DBPath,
+		tempDir:        cfg.BackupDir,
+		mode:           cfg.BackupMode,
+		walCheckpoint:  cfg.WALCheckpoint,
+		integrityCheck: cfg.IntegrityCheck,
+		cmd:            cmd,
+	}, nil
+}
+
+func (s *sqliteSource) Name() string { return s.name }
+
+func (s *sqliteSource) Type() string { return "sqlite" }
+
+// Extension is .sql for historical reasons, backups have always been named
+// like this even though they contain the database file rather than SQL.
+func (s *sqliteSource) Extension() string { return ".sql" }
+
+func (s *sqliteSource) Dump(ctx context.Context, w io.Writer) error {
+	if s.cmd != nil {
+		return s.cmd.run(ctx, sqliteContainerArgs(s.dbPath, s.integrityCheck, s.mode), nil, w)
+	}
+
+	// A corrupt database would be archived faithfully and replace the last
+	// good backups over time, fail loudly instead.
+	if s.integrityCheck != "off" {
+		if err := sqliteIntegrityCheck(ctx, s.dbPath, s.integrityCheck); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.tempDir, s.name+"-*.db")
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	prepareWAL(ctx, s.dbPath, s.walCheckpoint)
+
+	if s.mode == "vacuum" {
+		err = sqliteVacuumInto(ctx, s.dbPath, tmp.Name())
+	} else {
+		err = sqliteBackup(ctx, s.dbPath, tmp.Name())
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := makeStandalone(ctx, tmp.Name()); err != nil {
+		return err
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to copy backup file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqliteSource) Metadata() map[string]string {
+	version, ok := sqliteUserVersion(s.dbPath)
+	if !ok {
+		return nil
+	}
+
+	return map[string]string{"schema-version": strconv.FormatUint(uint64(version), 10)}
+}
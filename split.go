@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+)
+
+// splitManifest describes a backup that was uploaded in parts. It is
+// uploaded last, as <key>.manifest.json, so a backup with a manifest is
+// complete. The parts are restored by concatenating them in order, e.g.
+// cat <key>.part* > backup, and checking the result against SHA256.
+type splitManifest struct {
+	Version int         `json:"version"`
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	SHA256  string      `json:"sha256"`
+	Parts   []splitPart `json:"parts"`
+}
+
+type splitPart struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// storeBackup uploads the backup at filePath to dest, in parts if it is
+// larger than SPLIT_SIZE.
+func storeBackup(ctx context.Context, cfg *Config, dest Destination, key, filePath string, metadata map[string]string) error {
+	if split, err := needsSplit(cfg, filePath); err != nil || !split {
+		return uploadWithRetry(ctx, cfg, dest, key, filePath, metadata)
+	}
+
+	return uploadSplit(ctx, cfg, dest, key, filePath, metadata)
+}
+
+// needsSplit reports whether the backup at filePath is uploaded in parts.
+func needsSplit(cfg *Config, filePath string) (bool, error) {
+	if cfg.SplitSize <= 0 {
+		return false, nil
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	return info.Size() > cfg.SplitSize, nil
+}
+
+// uploadSplit uploads the backup at filePath as parts of SPLIT_SIZE bytes,
+// named <key>.part0001 and so on, followed by the manifest. Each part is
+// retried on its own, and parts that are already on dest with the right
+// size, from an earlier attempt, aren't uploaded again.
+func uploadSplit(ctx context.Context, cfg *Config, dest Destination, key, filePath string, metadata map[string]string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file for upload: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file for upload: %w", err)
+	}
+
+	existing := map[string]int64{}
+	if objects, err := dest.Storage.List(ctx, key); err == nil {
+		for _, obj := range objects {
+			existing[obj.Key] = obj.Size
+		}
+	}
+
+	manifest := splitManifest{Version: 1, Name: path.Base(key), Size: info.Size()}
+	whole := sha256.New()
+	for offset, n := int64(0), 1; offset < info.Size(); offset, n = offset+cfg.SplitSize, n+1 {
+		size := cfg.SplitSize
+		if offset+size > info.Size() {
+			size = info.Size() - offset
+		}
+
+		partSum := sha256.New()
+		section := io.NewSectionReader(file, offset, size)
+		if _, err := io.Copy(io.MultiWriter(whole, partSum), section); err != nil {
+			return fmt.Errorf("failed to read file for upload: %w", err)
+		}
+
+		partKey := fmt.Sprintf("%s.part%04d", key, n)
+		manifest.Parts = append(manifest.Parts, splitPart{
+			Name:   path.Base(partKey),
+			Size:   size,
+			SHA256: hex.EncodeToString(partSum.Sum(nil)),
+		})
+
+		if existing[partKey] == size {
+			slog.Info("Part is already on the destination", "job", "backup", "destination", dest.Name, "key", manifest.Name, "part", n)
+			continue
+		}
+
+		err := withRetry(cfg, dest, func() error {
+			return dest.Storage.Put(ctx, partKey, io.NewSectionReader(file, offset, size), size, metadata)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", n, err)
+		}
+	}
+	manifest.SHA256 = hex.EncodeToString(whole.Sum(nil))
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	return withRetry(cfg, dest, func() error {
+		return dest.Storage.Put(ctx, key+".manifest.json", bytes.NewReader(data), int64(len(data)), metadata)
+	})
+}
+
+// readManifest downloads the manifest of the split backup at key.
+func readManifest(ctx context.Context, storage StorageBackend, key string) (splitManifest, error) {
+	var manifest splitManifest
+
+	r, err := storage.Get(ctx, key+".manifest.json")
+	if err != nil {
+		return manifest, err
+	}
+	defer r.Close()
+
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest of split backup: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// openSplit returns a reader over the parts of the split backup at key, in
+// order, checking every part and the whole backup against the checksums in
+// manifest.
+func openSplit(ctx context.Context, storage StorageBackend, key string, manifest splitManifest) io.ReadCloser {
+	return &splitReader{ctx: ctx, storage: storage, prefix: path.Dir(key), manifest: manifest, whole: sha256.New()}
+}
+
+type splitReader struct {
+	ctx      context.Context
+	storage  StorageBackend
+	prefix   string
+	manifest splitManifest
+	whole    hash.Hash
+
+	next    int
+	part    io.ReadCloser
+	partSum hash.Hash
+}
+
+func (s *splitReader) Read(p []byte) (int, error) {
+	for s.part == nil {
+		if s.next == len(s.manifest.Parts) {
+			if hex.EncodeToString(s.whole.Sum(nil)) != s.manifest.SHA256 {
+				return 0, fmt.Errorf("checksum mismatch for %s", s.manifest.Name)
+			}
+			return 0, io.EOF
+		}
+
+		part, err := s.storage.Get(s.ctx, path.Join(s.prefix, s.manifest.Parts[s.next].Name))
+		if err != nil {
+			return 0, fmt.Errorf("failed to download part %d: %w", s.next+1, err)
+		}
+		s.part, s.partSum = part, sha256.New()
+	}
+
+	n, err := s.part.Read(p)
+	s.whole.Write(p[:n])
+	s.partSum.Write(p[:n])
+	if err == io.EOF {
+		s.part.Close()
+		s.part = nil
+		if hex.EncodeToString(s.partSum.Sum(nil)) != s.manifest.Parts[s.next].SHA256 {
+			return n, fmt.Errorf("checksum mismatch for part %d", s.next+1)
+		}
+		s.next++
+		err = nil
+	}
+
+	return n, err
+}
+
+func (s *splitReader) Close() error {
+	if s.part != nil {
+		return s.part.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteBusyTimeout is how long SQLite waits for a write lock held by the
+// application to be released before giving up, in milliseconds.
+const sqliteBusyTimeout = 30000
+
+// openSQLite opens the database at path. Read-only connections also work on
+// databases mounted read-only.
+func openSQLite(path string, readOnly bool) (*sql.DB, error) {
+	params := url.Values{}
+	params.Set("_busy_timeout", fmt.Sprint(sqliteBusyTimeout))
+	if readOnly {
+		params.Set("mode", "ro")
+	}
+
+	return sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+}
+
+// sqliteBackup copies the database at dbPath to backupPath with the SQLite
+// online backup API. Unlike a plain file copy, the result is a consistent
+// snapshot even if the application writes to the database meanwhile.
+func sqliteBackup(ctx context.Context, dbPath, backupPath string) error {
+	// The backup API overwrites the destination page by page, start from an
+	// empty file so no stale pages of an earlier run are left behind.
+	if err := removeBackupFile(backupPath); err != nil {
+		return err
+	}
+
+	srcDB, err := openSQLite(dbPath, true)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer srcDB.Close()
+
+	dstDB, err := openSQLite(backupPath, false)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	defer dstDB.Close()
+
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer srcConn.Close()
+
+	dstConn, err := dstDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	defer dstConn.Close()
+
+	err = dstConn.Raw(func(dst interface{}) error {
+		return srcConn.Raw(func(src interface{}) error {
+			backup, err := dst.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			// Copying all pages in a single step holds a read lock for the
+			// whole copy. Copying in smaller steps would let writers in between,
+			// but every write restarts the backup, so a busy database might
+			// never finish.
+			if _, err := backup.Step(-1); err != nil {
+				backup.Close()
+				return err
+			}
+
+			return backup.Finish()
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteVacuumInto writes a compacted copy of the database at dbPath to
+// backupPath with VACUUM INTO. The copy is just as consistent as one made with
+// the backup API, but leaves out free pages and defragments tables and
+// indexes, which makes it smaller for databases with a lot of deleted data.
+// It is slower though, as every table and index is rebuilt.
+func sqliteVacuumInto(ctx context.Context, dbPath, backupPath string) error {
+	// VACUUM INTO refuses to overwrite an existing file.
+	if err := removeBackupFile(backupPath); err != nil {
+		return err
+	}
+
+	db, err := openSQLite(dbPath, true)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", backupPath); err != nil {
+		return fmt.Errorf("failed to vacuum database into backup file: %w", err)
+	}
+
+	return nil
+}
+
+func removeBackupFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old backup file: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteHeader reads the 100 byte header of the database at path. It reports
+// false if the file can't be read or isn't an SQLite database.
+func sqliteHeader(path string) ([]byte, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, false
+	}
+	if !bytes.HasPrefix(header, []byte("SQLite format 3\x00")) {
+		return nil, false
+	}
+
+	return header, true
+}
+
+// sqliteWALMode reports whether the database at path uses write-ahead
+// logging, which the file format version numbers in the header are set to 2
+// for.
+func sqliteWALMode(path string) bool {
+	header, ok := sqliteHeader(path)
+	return ok && header[18] == 2 && header[19] == 2
+}
+
+// prepareWAL makes sure that transactions still sitting in the write-ahead
+// log of a database in WAL mode end up in the backup. SQLite reads them from
+// the -wal file next to the database, so that file has to be visible; when
+// only the database file itself is mounted into the container, they would be
+// silently missing. With checkpoint set, the log is first written back into
+// the database file, which needs write access to the database.
+func prepareWAL(ctx context.Context, dbPath string, checkpoint bool) {
+	if !sqliteWALMode(dbPath) {
+		return
+	}
+
+	if _, err := os.Stat(dbPath + "-wal"); os.IsNotExist(err) {
+		slog.Warn("Database is in WAL mode, but its -wal file is not visible. Transactions that haven't been checkpointed yet are missing from the backup; mount the directory of the database instead of just the file", "path", dbPath)
+		return
+	}
+
+	if !checkpoint {
+		return
+	}
+
+	db, err := openSQLite(dbPath, false)
+	if err != nil {
+		slog.Warn("Failed to checkpoint WAL", "path", dbPath, "error", err)
+		return
+	}
+	defer db.Close()
+
+	// A passive checkpoint never waits for the application, whatever it
+	// can't write back now is still read from the -wal file by the backup.
+	var busy, logFrames, checkpointed int
+	err = db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		slog.Warn("Failed to checkpoint WAL", "path", dbPath, "error", err)
+		return
+	}
+	slog.Debug("Checkpointed WAL frames", "job", "backup", "path", dbPath, "checkpointed", checkpointed, "frames", logFrames)
+}
+
+// makeStandalone switches a backup copy of a WAL mode database back to a
+// rollback journal, so the backup is a single self-contained file that can be
+// opened read-only without -wal and -shm files.
+func makeStandalone(ctx context.Context, backupPath string) error {
+	if !sqliteWALMode(backupPath) {
+		return nil
+	}
+
+	db, err := openSQLite(backupPath, false)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, "PRAGMA journal_mode=DELETE"); err != nil {
+		return fmt.Errorf("failed to disable WAL mode of backup file: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteIntegrityCheck runs PRAGMA integrity_check, or the faster
+// quick_check that skips verifying indexes against their tables, on the
+// database at dbPath and returns an error describing the problems if it is
+// corrupt.
+func sqliteIntegrityCheck(ctx context.Context, dbPath, mode string) error {
+	db, err := openSQLite(dbPath, true)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	pragma := "integrity_check"
+	if mode == "quick" {
+		pragma = "quick_check"
+	}
+
+	// Only the first problems are reported, a badly damaged database can
+	// have thousands.
+	rows, err := db.QueryContext(ctx, "PRAGMA "+pragma+"(10)")
+	if err != nil {
+		return fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return fmt.Errorf("failed to check database integrity: %w", err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check database integrity: %w", err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("database %s is corrupt: %s", dbPath, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// lockSQLite takes an exclusive lock on the database at path, which keeps
+// other connections from writing to it, waiting for a write in progress to
+// finish first. The lock is held until unlock is called.
+func lockSQLite(ctx context.Context, path string) (unlock func(), err error) {
+	db, err := openSQLite(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN EXCLUSIVE"); err != nil {
+		conn.Close()
+		db.Close()
+		return nil, err
+	}
+
+	return func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+		db.Close()
+	}, nil
+}
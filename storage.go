@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupObject describes a single backup stored in a StorageBackend.
+type BackupObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// StorageBackend is a destination backups can be uploaded to. Implementations
+// register themselves by name with registerStorageBackend and are selected
+// with the STORAGE_BACKEND environment variable. Backends that can attach
+// metadata to stored objects do so with the metadata passed to Put, others
+// ignore it.
+type StorageBackend interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error
+	List(ctx context.Context, prefix string) ([]BackupObject, error)
+	Delete(ctx context.Context, key string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+type storageBackendFactory func(cfg *Config) (StorageBackend, error)
+
+var storageBackends = map[string]storageBackendFactory{}
+
+func registerStorageBackend(name string, factory storageBackendFactory) {
+	storageBackends[name] = factory
+}
+
+// ServerSideCopier is implemented by backends that can copy an object from
+// another backend of the same kind without downloading and uploading it.
+type ServerSideCopier interface {
+	CopyFrom(ctx context.Context, src StorageBackend, key string) error
+}
+
+// MetadataReader is implemented by backends that can return the metadata
+// stored with an object without downloading it.
+type MetadataReader interface {
+	Metadata(ctx context.Context, key string) (map[string]string, error)
+}
+
+// LifecycleConfigurer is implemented by backends whose bucket can expire
+// objects under a prefix server-side, once they are older than days.
+type LifecycleConfigurer interface {
+	SetLifecycle(ctx context.Context, prefix string, days int) error
+}
+
+// Destination is a storage backend together with the name it was selected
+// by. The first configured destination is the primary one. A failover
+// destination is only used when the upload to the primary one fails, a
+// replica receives a copy of every backup stored on the primary.
+type Destination struct {
+	Name      string
+	Storage   StorageBackend
+	KeyPrefix string
+	Retention retentionPolicy
+	Failover  bool
+	Replica   bool
+}
+
+func newDestinations(cfg *Config) ([]Destination, error) {
+	if len(cfg.StorageBackends) == 0 {
+		return nil, fmt.Errorf("no storage backend configured")
+	}
+
+	destinations := make([]Destination, 0, len(cfg.StorageBackends))
+	for _, name := range cfg.StorageBackends {
+		storage, err := newStorageBackend(name, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		destinations = append(destinations, Destination{
+			Name:      name,
+			Storage:   storage,
+			KeyPrefix: keyPrefixFor(cfg, name),
+			Retention: newRetentionPolicy(cfg, cfg.RetentionDays),
+		})
+	}
+
+	if cfg.FailoverBackend != "" {
+		storage, err := newStorageBackend(cfg.FailoverBackend, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s (failover): %w", cfg.FailoverBackend, err)
+		}
+		destinations = append(destinations, Destination{
+			Name:      cfg.FailoverBackend,
+			Storage:   storage,
+			KeyPrefix: keyPrefixFor(cfg, cfg.FailoverBackend),
+			Retention: newRetentionPolicy(cfg, cfg.RetentionDays),
+			Failover:  true,
+		})
+	}
+
+	if cfg.ReplicaBucket != "" {
+		storage, err := newReplicaBackend(cfg.StorageBackends[0], cfg)
+		if err != nil {
+			return nil, fmt.Errorf("replica: %w", err)
+		}
+		destinations = append(destinations, Destination{
+			Name:      cfg.StorageBackends[0] + "-replica",
+			Storage:   storage,
+			KeyPrefix: keyPrefixFor(cfg, cfg.StorageBackends[0]),
+			Retention: newRetentionPolicy(cfg, cfg.ReplicaRetentionDays),
+			Replica:   true,
+		})
+	}
+
+	return destinations, nil
+}
+
+// keyPrefixFor returns the key prefix template for a backend, which can be
+// overridden per backend with KEY_PREFIX_<NAME>.
+func keyPrefixFor(cfg *Config, name string) string {
+	if prefix, ok := cfg.KeyPrefixes[name]; ok {
+		return prefix
+	}
+
+	return cfg.KeyPrefix
+}
+
+func newStorageBackend(name string, cfg *Config) (StorageBackend, error) {
+	factory, ok := storageBackends[name]
+	if !ok {
+		names := make([]string, 0, len(storageBackends))
+		for name := range storageBackends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown storage backend %q (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	return factory(cfg)
+}
+
+// prefixDir returns the directory part of a key prefix, i.e. the deepest
+// directory that can contain keys starting with prefix. Backends that store
+// backups as files walk this directory when listing.
+func prefixDir(prefix string) string {
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		return prefix[:i]
+	}
+
+	return ""
+}
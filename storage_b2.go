@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerStorageBackend("b2", newB2Backend)
+}
+
+const b2AuthorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+// B2 authorization tokens are valid for 24 hours, refresh well before that.
+const b2AuthLifetime = 12 * time.Hour
+
+// b2Backend talks to the native Backblaze B2 API. Files larger than the
+// account's recommended part size are uploaded with the large file API.
+type b2Backend struct {
+	keyID          string
+	applicationKey string
+	bucketName     string
+	httpClient     *http.Client
+
+	mu           sync.Mutex
+	auth         *b2Auth
+	authorizedAt time.Time
+	bucketID     string
+}
+
+type b2Auth struct {
+	AccountID           string `json:"accountId"`
+	AuthorizationToken  string `json:"authorizationToken"`
+	APIURL              string `json:"apiUrl"`
+	DownloadURL         string `json:"downloadUrl"`
+	RecommendedPartSize int64  `json:"recommendedPartSize"`
+	Allowed             struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("b2 error %d (%s): %s", e.Status, e.Code, e.Message)
+}
+
+type b2File struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	ContentLength   int64  `json:"contentLength"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+	Action          string `json:"action"`
+}
+
+type b2UploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+func newB2Backend(cfg *Config) (StorageBackend, error) {
+	err := checkRequired(map[string]string{
+		"B2_KEY_ID":          cfg.B2KeyID,
+		"B2_APPLICATION_KEY": cfg.B2ApplicationKey,
+		"B2_BUCKET":          cfg.B2Bucket,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &b2Backend{
+		keyID:          cfg.B2KeyID,
+		applicationKey: cfg.B2ApplicationKey,
+		bucketName:     cfg.B2Bucket,
+		httpClient:     &http.Client{},
+	}, nil
+}
+
+// authorize returns a valid account authorization, logging in again when the
+// cached token is close to expiring.
+func (b *b2Backend) authorize(ctx context.Context) (*b2Auth, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.auth != nil && time.Since(b.authorizedAt) < b2AuthLifetime {
+		return b.auth, b.bucketID, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b2AuthorizeURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.SetBasicAuth(b.keyID, b.applicationKey)
+
+	auth := &b2Auth{}
+	if err := b.do(req, auth); err != nil {
+		return nil, "", fmt.Errorf("failed to authorize B2 account: %w", err)
+	}
+
+	bucketID := auth.Allowed.BucketID
+	if bucketID == "" || auth.Allowed.BucketName != b.bucketName {
+		var resp struct {
+			Buckets []struct {
+				BucketID string `json:"bucketId"`
+			} `json:"buckets"`
+		}
+		err := b.call(ctx, auth, "b2_list_buckets", map[string]string{
+			"accountId":  auth.AccountID,
+			"bucketName": b.bucketName,
+		}, &resp)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to look up B2 bucket: %w", err)
+		}
+		if len(resp.Buckets) == 0 {
+			return nil, "", fmt.Errorf("B2 bucket %q not found", b.bucketName)
+		}
+		bucketID = resp.Buckets[0].BucketID
+	}
+
+	b.auth = auth
+	b.authorizedAt = time.Now()
+	b.bucketID = bucketID
+
+	return auth, bucketID, nil
+}
+
+// call invokes a B2 API operation with a JSON request body.
+func (b *b2Backend) call(ctx context.Context, auth *b2Auth, operation string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.APIURL+"/b2api/v2/"+operation, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	return b.do(req, out)
+}
+
+func (b *b2Backend) do(req *http.Request, out interface{}) error {
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &b2Error{Status: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil {
+			apiErr.Message = resp.Status
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (b *b2Backend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	auth, bucketID, err := b.authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	if size > auth.RecommendedPartSize {
+		err = b.putLargeFile(ctx, auth, bucketID, key, body, size, metadata)
+	} else {
+		err = b.putSmallFile(ctx, auth, bucketID, key, body, size, metadata)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload to B2: %w", err)
+	}
+
+	return nil
+}
+
+func (b *b2Backend) putSmallFile(ctx context.Context, auth *b2Auth, bucketID, key string, body io.Reader, size int64, metadata map[string]string) error {
+	var upload b2UploadURL
+	if err := b.call(ctx, auth, "b2_get_upload_url", map[string]string{"bucketId": bucketID}, &upload); err != nil {
+		return err
+	}
+
+	req, err := newB2UploadRequest(ctx, upload, body, size)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Bz-File-Name", b2EscapeName(key))
+	req.Header.Set("Content-Type", "b2/x-auto")
+	for k, v := range metadata {
+		req.Header.Set("X-Bz-Info-"+k, url.QueryEscape(v))
+	}
+
+	return b.do(req, nil)
+}
+
+func (b *b2Backend) putLargeFile(ctx context.Context, auth *b2Auth, bucketID, key string, body io.Reader, size int64, metadata map[string]string) error {
+	var file b2File
+	err := b.call(ctx, auth, "b2_start_large_file", map[string]interface{}{
+		"bucketId":    bucketID,
+		"fileName":    key,
+		"contentType": "b2/x-auto",
+		"fileInfo":    metadata,
+	}, &file)
+	if err != nil {
+		return err
+	}
+
+	if err := b.uploadParts(ctx, auth, file.FileID, body, size); err != nil {
+		// Don't leave unfinished large files around, they are billed as storage.
+		b.call(ctx, auth, "b2_cancel_large_file", map[string]string{"fileId": file.FileID}, nil)
+		return err
+	}
+
+	return nil
+}
+
+func (b *b2Backend) uploadParts(ctx context.Context, auth *b2Auth, fileID string, body io.Reader, size int64) error {
+	var upload b2UploadURL
+	if err := b.call(ctx, auth, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, &upload); err != nil {
+		return err
+	}
+
+	var partSHA1s []string
+	for part, remaining := 1, size; remaining > 0; part++ {
+		partSize := auth.RecommendedPartSize
+		if remaining < partSize {
+			partSize = remaining
+		}
+
+		h := sha1.New()
+		req, err := newB2UploadRequest(ctx, upload, io.TeeReader(io.LimitReader(body, partSize), h), partSize)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Bz-Part-Number", strconv.Itoa(part))
+
+		if err := b.do(req, nil); err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", part, err)
+		}
+
+		partSHA1s = append(partSHA1s, hex.EncodeToString(h.Sum(nil)))
+		remaining -= partSize
+	}
+
+	return b.call(ctx, auth, "b2_finish_large_file", map[string]interface{}{
+		"fileId":        fileID,
+		"partSha1Array": partSHA1s,
+	}, nil)
+}
+
+// newB2UploadRequest streams body to an upload URL. The SHA1 checksum B2
+// requires is computed while streaming and appended after the content, so
+// the data only has to be read once.
+func newB2UploadRequest(ctx context.Context, upload b2UploadURL, body io.Reader, size int64) (*http.Request, error) {
+	h := sha1.New()
+	payload := io.MultiReader(io.TeeReader(body, h), &sha1SuffixReader{hash: h})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upload.UploadURL, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size + sha1.Size*2
+	req.Header.Set("Authorization", upload.AuthorizationToken)
+	req.Header.Set("X-Bz-Content-Sha1", "hex_digits_at_end")
+
+	return req, nil
+}
+
+// sha1SuffixReader yields the hex encoded digest of hash once the content
+// preceding it in a MultiReader has been consumed.
+type sha1SuffixReader struct {
+	hash   hash.Hash
+	digest io.Reader
+}
+
+func (r *sha1SuffixReader) Read(p []byte) (int, error) {
+	if r.digest == nil {
+		r.digest = strings.NewReader(hex.EncodeToString(r.hash.Sum(nil)))
+	}
+	return r.digest.Read(p)
+}
+
+func (b *b2Backend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	auth, bucketID, err := b.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []BackupObject
+	startFileName := ""
+	for {
+		var resp struct {
+			Files        []b2File `json:"files"`
+			NextFileName *string  `json:"nextFileName"`
+		}
+		err := b.call(ctx, auth, "b2_list_file_names", map[string]interface{}{
+			"bucketId":      bucketID,
+			"prefix":        prefix,
+			"startFileName": startFileName,
+			"maxFileCount":  1000,
+		}, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list B2 files: %w", err)
+		}
+
+		for _, f := range resp.Files {
+			if f.Action != "upload" {
+				continue
+			}
+			objects = append(objects, BackupObject{
+				Key:          f.FileName,
+				Size:         f.ContentLength,
+				LastModified: time.UnixMilli(f.UploadTimestamp),
+			})
+		}
+
+		if resp.NextFileName == nil {
+			break
+		}
+		startFileName = *resp.NextFileName
+	}
+
+	return objects, nil
+}
+
+// Delete removes every version of key, so deleted backups stop being billed.
+func (b *b2Backend) Delete(ctx context.Context, key string) error {
+	auth, bucketID, err := b.authorize(ctx)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Files []b2File `json:"files"`
+	}
+	err = b.call(ctx, auth, "b2_list_file_versions", map[string]interface{}{
+		"bucketId":      bucketID,
+		"prefix":        key,
+		"startFileName": key,
+		"maxFileCount":  1000,
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to delete B2 file: %w", err)
+	}
+
+	for _, f := range resp.Files {
+		if f.FileName != key {
+			continue
+		}
+		err := b.call(ctx, auth, "b2_delete_file_version", map[string]string{
+			"fileName": f.FileName,
+			"fileId":   f.FileID,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete B2 file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (b *b2Backend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	auth, _, err := b.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	downloadURL := fmt.Sprintf("%s/file/%s/%s", auth.DownloadURL, url.PathEscape(b.bucketName), b2EscapeName(key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from B2: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download from B2: %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// b2EscapeName percent-encodes a file name for use in headers and download
+// URLs. Slashes are kept as they are, as B2 expects.
+func b2EscapeName(name string) string {
+	return strings.ReplaceAll(url.PathEscape(name), "%2F", "/")
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerStorageBackend("dropbox", newDropboxBackend)
+}
+
+const (
+	dropboxAPIURL     = "https://api.dropboxapi.com/2/"
+	dropboxContentURL = "https://content.dropboxapi.com/2/"
+	dropboxTokenURL   = "https://api.dropbox.com/oauth2/token"
+
+	// Single requests to files/upload are limited to 150 MB, anything larger
+	// goes through an upload session in chunks of this size.
+	dropboxMaxSingleUpload = 150 << 20
+	dropboxChunkSize       = 32 << 20
+)
+
+// dropboxBackend stores backups in a Dropbox folder. It authenticates either
+// with a fixed access token or with a refresh token, which is exchanged for
+// short-lived access tokens as needed.
+type dropboxBackend struct {
+	dir          string
+	refreshToken string
+	appKey       string
+	appSecret    string
+	httpClient   *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+type dropboxError struct {
+	Status  int
+	Summary string `json:"error_summary"`
+}
+
+func (e *dropboxError) Error() string {
+	return fmt.Sprintf("dropbox error %d: %s", e.Status, e.Summary)
+}
+
+type dropboxCursor struct {
+	SessionID string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+type dropboxCommit struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Mute bool   `json:"mute"`
+}
+
+func newDropboxBackend(cfg *Config) (StorageBackend, error) {
+	b := &dropboxBackend{
+		dir:          cfg.DropboxDir,
+		accessToken:  cfg.DropboxAccessToken,
+		refreshToken: cfg.DropboxRefreshToken,
+		appKey:       cfg.DropboxAppKey,
+		appSecret:    cfg.DropboxAppSecret,
+		httpClient:   &http.Client{},
+	}
+
+	if b.refreshToken != "" {
+		err := checkRequired(map[string]string{
+			"DROPBOX_APP_KEY":    b.appKey,
+			"DROPBOX_APP_SECRET": b.appSecret,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if b.accessToken == "" {
+		return nil, fmt.Errorf("either DROPBOX_ACCESS_TOKEN or DROPBOX_REFRESH_TOKEN must be set")
+	}
+
+	return b, nil
+}
+
+func (b *dropboxBackend) token(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.refreshToken == "" || (b.accessToken != "" && time.Now().Before(b.expiresAt)) {
+		return b.accessToken, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {b.refreshToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dropboxTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(b.appKey, b.appSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := b.do(req, &resp); err != nil {
+		return "", fmt.Errorf("failed to refresh Dropbox access token: %w", err)
+	}
+
+	// Refresh a minute early so a token never expires mid-request.
+	b.accessToken = resp.AccessToken
+	b.expiresAt = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - time.Minute)
+
+	return b.accessToken, nil
+}
+
+// rpc calls an endpoint of the Dropbox RPC API, which takes and returns JSON.
+func (b *dropboxBackend) rpc(ctx context.Context, endpoint string, arg, out interface{}) error {
+	payload, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+
+	req, err := b.newRequest(ctx, dropboxAPIURL+endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return b.do(req, out)
+}
+
+// content calls an endpoint of the Dropbox content API, which takes its
+// arguments in the Dropbox-API-Arg header and file data as the body.
+func (b *dropboxBackend) content(ctx context.Context, endpoint string, arg interface{}, body io.Reader) (*http.Request, error) {
+	header, err := dropboxAPIArg(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := b.newRequest(ctx, dropboxContentURL+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Dropbox-API-Arg", header)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	return req, nil
+}
+
+func (b *dropboxBackend) newRequest(ctx context.Context, url string, body io.Reader) (*http.Request, error) {
+	token, err := b.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return req, nil
+}
+
+func (b *dropboxBackend) do(req *http.Request, out interface{}) error {
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &dropboxError{Status: resp.StatusCode}
+		body, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(body, apiErr) != nil || apiErr.Summary == "" {
+			apiErr.Summary = strings.TrimSpace(string(body))
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// dropboxAPIArg encodes v for the Dropbox-API-Arg header, which only allows
+// ASCII, so every other character is escaped.
+func dropboxAPIArg(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, r := range string(data) {
+		if r > 0x7f {
+			if r > 0xffff {
+				r1, r2 := (r-0x10000)>>10+0xd800, (r-0x10000)&0x3ff+0xdc00
+				fmt.Fprintf(&sb, `\u%04x\u%04x`, r1, r2)
+			} else {
+				fmt.Fprintf(&sb, `\u%04x`, r)
+			}
+			continue
+		}
+		sb.WriteRune(r)
+	}
+
+	return sb.String(), nil
+}
+
+func (b *dropboxBackend) remotePath(key string) string {
+	return path.Join("/", b.dir, key)
+}
+
+func (b *dropboxBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	commit := dropboxCommit{Path: b.remotePath(key), Mode: "overwrite", Mute: true}
+
+	var err error
+	if size <= dropboxMaxSingleUpload {
+		var req *http.Request
+		req, err = b.content(ctx, "files/upload", commit, body)
+		if err == nil {
+			req.ContentLength = size
+			err = b.do(req, nil)
+		}
+	} else {
+		err = b.putSession(ctx, commit, body, size)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload to Dropbox: %w", err)
+	}
+
+	return nil
+}
+
+// putSession uploads body in chunks through an upload session, which is
+// required for files larger than 150 MB.
+func (b *dropboxBackend) putSession(ctx context.Context, commit dropboxCommit, body io.Reader, size int64) error {
+	req, err := b.content(ctx, "files/upload_session/start", map[string]bool{"close": false}, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	var cursor dropboxCursor
+	if err := b.do(req, &cursor); err != nil {
+		return err
+	}
+
+	for {
+		n := min(dropboxChunkSize, size-cursor.Offset)
+		chunk := io.LimitReader(body, n)
+
+		if cursor.Offset+n == size {
+			req, err = b.content(ctx, "files/upload_session/finish", map[string]interface{}{
+				"cursor": cursor,
+				"commit": commit,
+			}, chunk)
+		} else {
+			req, err = b.content(ctx, "files/upload_session/append_v2", map[string]interface{}{
+				"cursor": cursor,
+				"close":  false,
+			}, chunk)
+		}
+		if err != nil {
+			return err
+		}
+		req.ContentLength = n
+
+		if err := b.do(req, nil); err != nil {
+			return err
+		}
+
+		cursor.Offset += n
+		if cursor.Offset == size {
+			return nil
+		}
+	}
+}
+
+func (b *dropboxBackend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	root := b.remotePath(prefixDir(prefix))
+	if root == "/" {
+		root = "" // Dropbox refers to the root folder by the empty path
+	}
+
+	type listResult struct {
+		Entries []struct {
+			Tag            string    `json:".tag"`
+			PathLower      string    `json:"path_lower"`
+			PathDisplay    string    `json:"path_display"`
+			Size           int64     `json:"size"`
+			ServerModified time.Time `json:"server_modified"`
+		} `json:"entries"`
+		Cursor  string `json:"cursor"`
+		HasMore bool   `json:"has_more"`
+	}
+
+	lowerRoot, lowerPrefix := strings.ToLower(b.remotePath("")), strings.ToLower(prefix)
+	var objects []BackupObject
+	var result listResult
+	err := b.rpc(ctx, "files/list_folder", map[string]interface{}{
+		"path":      root,
+		"recursive": true,
+	}, &result)
+	for {
+		var apiErr *dropboxError
+		if errors.As(err, &apiErr) && strings.HasPrefix(apiErr.Summary, "path/not_found") {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list Dropbox files: %w", err)
+		}
+
+		for _, entry := range result.Entries {
+			if entry.Tag != "file" {
+				continue
+			}
+			// Only the last component of path_display is guaranteed to be
+			// in the case it was uploaded with, so the path is matched in
+			// lower case, and the key made up of prefix and file name.
+			rel := strings.TrimPrefix(strings.TrimPrefix(entry.PathLower, lowerRoot), "/")
+			if !strings.HasPrefix(rel, lowerPrefix) {
+				continue
+			}
+			key := prefix + rel[len(lowerPrefix):]
+			key = key[:strings.LastIndex(key, "/")+1] + path.Base(entry.PathDisplay)
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			objects = append(objects, BackupObject{
+				Key:          key,
+				Size:         entry.Size,
+				LastModified: entry.ServerModified,
+			})
+		}
+
+		if !result.HasMore {
+			return objects, nil
+		}
+
+		cursor := result.Cursor
+		result = listResult{}
+		err = b.rpc(ctx, "files/list_folder/continue", map[string]string{"cursor": cursor}, &result)
+	}
+}
+
+func (b *dropboxBackend) Delete(ctx context.Context, key string) error {
+	if err := b.rpc(ctx, "files/delete_v2", map[string]string{"path": b.remotePath(key)}, nil); err != nil {
+		return fmt.Errorf("failed to delete Dropbox file: %w", err)
+	}
+
+	return nil
+}
+
+func (b *dropboxBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := b.content(ctx, "files/download", map[string]string{"path": b.remotePath(key)}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from Dropbox: %w", err)
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from Dropbox: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download from Dropbox: %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
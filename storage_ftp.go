@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+func init() {
+	registerStorageBackend("ftp", newFTPBackend)
+}
+
+// ftpBackend stores backups on a plain FTP or FTPS server. Data connections
+// always use passive mode. Like the SFTP backend it connects per operation.
+type ftpBackend struct {
+	addr     string
+	user     string
+	password string
+	dir      string
+	options  []ftp.DialOption
+}
+
+func newFTPBackend(cfg *Config) (StorageBackend, error) {
+	err := checkRequired(map[string]string{
+		"FTP_HOST": cfg.FTPHost,
+		"FTP_USER": cfg.FTPUser,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	options := []ftp.DialOption{
+		ftp.DialWithTimeout(30 * time.Second),
+		ftp.DialWithDisabledEPSV(cfg.FTPDisableEPSV),
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.FTPHost,
+		InsecureSkipVerify: cfg.FTPTLSSkipVerify,
+	}
+	switch cfg.FTPTLS {
+	case "", "none":
+	case "explicit":
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	case "implicit":
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+	default:
+		return nil, fmt.Errorf("invalid FTP_TLS %q (expected none, explicit or implicit)", cfg.FTPTLS)
+	}
+
+	return &ftpBackend{
+		addr:     net.JoinHostPort(cfg.FTPHost, cfg.FTPPort),
+		user:     cfg.FTPUser,
+		password: cfg.FTPPassword,
+		dir:      cfg.FTPDir,
+		options:  options,
+	}, nil
+}
+
+func (b *ftpBackend) connect(ctx context.Context) (*ftp.ServerConn, error) {
+	conn, err := ftp.Dial(b.addr, append(b.options, ftp.DialWithContext(ctx))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to FTP server: %w", err)
+	}
+
+	if err := conn.Login(b.user, b.password); err != nil {
+		conn.Quit()
+		return nil, fmt.Errorf("failed to log in to FTP server: %w", err)
+	}
+
+	return conn, nil
+}
+
+func (b *ftpBackend) remotePath(key string) string {
+	return path.Join(b.dir, key)
+}
+
+func (b *ftpBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	conn, err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Quit()
+
+	remote := b.remotePath(key)
+
+	// Create missing parent directories one by one, FTP has no mkdir -p.
+	// Errors are ignored since the directory usually exists already.
+	parts := strings.Split(path.Dir(remote), "/")
+	for i := range parts {
+		conn.MakeDir(strings.Join(parts[:i+1], "/"))
+	}
+
+	if err := conn.Stor(remote, body); err != nil {
+		return fmt.Errorf("failed to upload to FTP: %w", err)
+	}
+
+	return nil
+}
+
+func (b *ftpBackend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	conn, err := b.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Quit()
+
+	var objects []BackupObject
+	if err := b.walk(conn, prefixDir(prefix), prefix, &objects); err != nil {
+		return nil, fmt.Errorf("failed to list FTP files: %w", err)
+	}
+
+	return objects, nil
+}
+
+func (b *ftpBackend) walk(conn *ftp.ServerConn, dir, prefix string, objects *[]BackupObject) error {
+	entries, err := conn.List(b.remotePath(dir))
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code == ftp.StatusFileUnavailable {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+
+		key := strings.TrimPrefix(path.Join(dir, entry.Name), "/")
+		switch entry.Type {
+		case ftp.EntryTypeFolder:
+			if err := b.walk(conn, key, prefix, objects); err != nil {
+				return err
+			}
+		case ftp.EntryTypeFile:
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			*objects = append(*objects, BackupObject{
+				Key:          key,
+				Size:         int64(entry.Size),
+				LastModified: entry.Time,
+			})
+		}
+	}
+
+	return nil
+}
+
+func (b *ftpBackend) Delete(ctx context.Context, key string) error {
+	conn, err := b.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Quit()
+
+	if err := conn.Delete(b.remotePath(key)); err != nil {
+		return fmt.Errorf("failed to delete FTP file: %w", err)
+	}
+
+	return nil
+}
+
+func (b *ftpBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	conn, err := b.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := conn.Retr(b.remotePath(key))
+	if err != nil {
+		conn.Quit()
+		return nil, fmt.Errorf("failed to download from FTP: %w", err)
+	}
+
+	return &ftpReadCloser{Response: resp, conn: conn}, nil
+}
+
+// ftpReadCloser ends the FTP session once the download has been closed.
+type ftpReadCloser struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+}
+
+func (r *ftpReadCloser) Close() error {
+	err := r.Response.Close()
+	r.conn.Quit()
+	return err
+}
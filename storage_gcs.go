@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	registerStorageBackend("gcs", newGCSBackend)
+}
+
+type gcsBackend struct {
+	client *storage.Client
+	bucket string
+}
+
+// newGCSBackend authenticates with the service account JSON file from
+// GCS_CREDENTIALS_FILE when set, and otherwise falls back to Application
+// Default Credentials (GOOGLE_APPLICATION_CREDENTIALS, workload identity or
+// the GCE metadata server).
+func newGCSBackend(cfg *Config) (StorageBackend, error) {
+	if err := checkRequired(map[string]string{"GCS_BUCKET": cfg.GCSBucket}); err != nil {
+		return nil, err
+	}
+
+	var opts []option.ClientOption
+	if cfg.GCSCredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.GCSCredentialsFile))
+	}
+
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+
+	return &gcsBackend{client: client, bucket: cfg.GCSBucket}, nil
+}
+
+func (b *gcsBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	// Closing the writer commits the object, so a failed upload is aborted
+	// by canceling its context instead, not to leave a partial backup.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := b.client.Bucket(b.bucket).Object(key).NewWriter(ctx)
+	w.Metadata = metadata
+	if _, err := io.Copy(w, body); err != nil {
+		cancel()
+		w.Close()
+		return fmt.Errorf("failed to upload to GCS: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to upload to GCS: %w", err)
+	}
+
+	return nil
+}
+
+func (b *gcsBackend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	var objects []BackupObject
+
+	it := b.client.Bucket(b.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list GCS objects: %w", err)
+		}
+
+		objects = append(objects, BackupObject{
+			Key:          attrs.Name,
+			Size:         attrs.Size,
+			LastModified: attrs.Updated,
+		})
+	}
+
+	return objects, nil
+}
+
+func (b *gcsBackend) Delete(ctx context.Context, key string) error {
+	if err := b.client.Bucket(b.bucket).Object(key).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete GCS object: %w", err)
+	}
+
+	return nil
+}
+
+// SetLifecycle replaces the delete rule for prefix in the lifecycle
+// configuration of the bucket, leaving the other rules in place.
+func (b *gcsBackend) SetLifecycle(ctx context.Context, prefix string, days int) error {
+	bucket := b.client.Bucket(b.bucket)
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read GCS bucket lifecycle: %w", err)
+	}
+
+	rules := []storage.LifecycleRule{{
+		Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{AgeInDays: int64(days), MatchesPrefix: []string{prefix}},
+	}}
+	for _, rule := range attrs.Lifecycle.Rules {
+		ours := rule.Action.Type == storage.DeleteAction && len(rule.Condition.MatchesPrefix) == 1 && rule.Condition.MatchesPrefix[0] == prefix
+		if !ours {
+			rules = append(rules, rule)
+		}
+	}
+
+	if _, err := bucket.Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &storage.Lifecycle{Rules: rules}}); err != nil {
+		return fmt.Errorf("failed to configure GCS bucket lifecycle: %w", err)
+	}
+
+	return nil
+}
+
+func (b *gcsBackend) Metadata(ctx context.Context, key string) (map[string]string, error) {
+	attrs, err := b.client.Bucket(b.bucket).Object(key).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GCS object metadata: %w", err)
+	}
+
+	return attrs.Metadata, nil
+}
+
+func (b *gcsBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := b.client.Bucket(b.bucket).Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from GCS: %w", err)
+	}
+
+	return r, nil
+}
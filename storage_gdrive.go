@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	registerStorageBackend("gdrive", newGDriveBackend)
+}
+
+// gdriveBackend stores backups in a Google Drive folder. Drive has no real
+// paths, so every backup is a file directly in the folder whose name is the
+// full key (e.g. "backups/app_backup_20240101_020000.sql.gz").
+type gdriveBackend struct {
+	service  *drive.Service
+	folderID string
+}
+
+// newGDriveBackend authenticates with an OAuth refresh token when one is
+// configured, and with a service account otherwise. Service accounts have no
+// storage quota of their own, so the folder has to live on a shared drive or
+// be shared with the service account.
+func newGDriveBackend(cfg *Config) (StorageBackend, error) {
+	if err := checkRequired(map[string]string{"GDRIVE_FOLDER_ID": cfg.GDriveFolderID}); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	var opts []option.ClientOption
+	switch {
+	case cfg.GDriveRefreshToken != "":
+		err := checkRequired(map[string]string{
+			"GDRIVE_CLIENT_ID":     cfg.GDriveClientID,
+			"GDRIVE_CLIENT_SECRET": cfg.GDriveClientSecret,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		oauthCfg := &oauth2.Config{
+			ClientID:     cfg.GDriveClientID,
+			ClientSecret: cfg.GDriveClientSecret,
+			Endpoint:     google.Endpoint,
+			Scopes:       []string{drive.DriveScope},
+		}
+		token := &oauth2.Token{RefreshToken: cfg.GDriveRefreshToken}
+		opts = append(opts, option.WithTokenSource(oauthCfg.TokenSource(ctx, token)))
+	case cfg.GDriveCredentialsFile != "":
+		opts = append(opts, option.WithCredentialsFile(cfg.GDriveCredentialsFile), option.WithScopes(drive.DriveScope))
+	default:
+		opts = append(opts, option.WithScopes(drive.DriveScope))
+	}
+
+	service, err := drive.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Google Drive client: %w", err)
+	}
+
+	return &gdriveBackend{service: service, folderID: cfg.GDriveFolderID}, nil
+}
+
+// find returns the files in the backup folder matching an extra query, the
+// most recently modified first.
+func (b *gdriveBackend) find(ctx context.Context, query string) ([]*drive.File, error) {
+	q := fmt.Sprintf("'%s' in parents and trashed = false", b.folderID)
+	if query != "" {
+		q += " and " + query
+	}
+
+	var files []*drive.File
+	err := b.service.Files.List().
+		Q(q).
+		Fields("nextPageToken, files(id, name, size, modifiedTime)").
+		OrderBy("modifiedTime desc").
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true).
+		Pages(ctx, func(page *drive.FileList) error {
+			files = append(files, page.Files...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// files returns the files named key, the most recently modified first. Drive
+// allows several files with the same name.
+func (b *gdriveBackend) files(ctx context.Context, key string) ([]*drive.File, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(key)
+	return b.find(ctx, fmt.Sprintf("name = '%s'", escaped))
+}
+
+func (b *gdriveBackend) fileID(ctx context.Context, key string) (string, error) {
+	files, err := b.files(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("file %s not found", key)
+	}
+
+	return files[0].Id, nil
+}
+
+// Put replaces the contents of the file named key if there is one, so files
+// that are rewritten, like the catalog, don't pile up as duplicates.
+func (b *gdriveBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	files, err := b.files(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to upload to Google Drive: %w", err)
+	}
+
+	if len(files) == 0 {
+		_, err = b.service.Files.Create(&drive.File{
+			Name:          key,
+			Parents:       []string{b.folderID},
+			AppProperties: metadata,
+		}).Media(body).SupportsAllDrives(true).Context(ctx).Do()
+	} else {
+		_, err = b.service.Files.Update(files[0].Id, &drive.File{
+			AppProperties: metadata,
+		}).Media(body).SupportsAllDrives(true).Context(ctx).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload to Google Drive: %w", err)
+	}
+
+	// Duplicates left behind by earlier versions, which always created a
+	// new file.
+	if len(files) > 1 {
+		for _, f := range files[1:] {
+			if err := b.service.Files.Delete(f.Id).SupportsAllDrives(true).Context(ctx).Do(); err != nil {
+				slog.Warn("Failed to delete duplicate Google Drive file", "key", key, "error", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *gdriveBackend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	files, err := b.find(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Google Drive files: %w", err)
+	}
+
+	var objects []BackupObject
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, prefix) {
+			continue
+		}
+
+		modified, err := time.Parse(time.RFC3339, f.ModifiedTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modification time for %s: %w", f.Name, err)
+		}
+
+		objects = append(objects, BackupObject{
+			Key:          f.Name,
+			Size:         f.Size,
+			LastModified: modified,
+		})
+	}
+
+	return objects, nil
+}
+
+func (b *gdriveBackend) Delete(ctx context.Context, key string) error {
+	id, err := b.fileID(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete Google Drive file: %w", err)
+	}
+
+	if err := b.service.Files.Delete(id).SupportsAllDrives(true).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to delete Google Drive file: %w", err)
+	}
+
+	return nil
+}
+
+func (b *gdriveBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	id, err := b.fileID(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from Google Drive: %w", err)
+	}
+
+	resp, err := b.service.Files.Get(id).SupportsAllDrives(true).Context(ctx).Download()
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from Google Drive: %w", err)
+	}
+
+	return resp.Body, nil
+}
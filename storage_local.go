@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerStorageBackend("local", newLocalBackend)
+}
+
+// localBackend stores backups in a directory on a mounted filesystem, such
+// as a NAS or NFS share.
+type localBackend struct {
+	dir string
+}
+
+func newLocalBackend(cfg *Config) (StorageBackend, error) {
+	if err := checkRequired(map[string]string{"LOCAL_DIR": cfg.LocalDir}); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.LocalDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create local storage directory: %w", err)
+	}
+
+	return &localBackend{dir: cfg.LocalDir}, nil
+}
+
+// path returns the file of key below dir. Keys that would resolve outside of
+// dir, like ../etc/passwd or absolute paths, are refused.
+func (b *localBackend) path(key string) (string, error) {
+	if key == "" {
+		return b.dir, nil
+	}
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid key %q: outside of LOCAL_DIR", key)
+	}
+
+	return filepath.Join(b.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first and renames it into place, so a
+// partially copied backup is never picked up by List.
+func (b *localBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	dst, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create local storage directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy to local storage: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync local file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to copy to local storage: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("failed to move local file into place: %w", err)
+	}
+
+	return nil
+}
+
+func (b *localBackend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	root, err := b.path(prefixDir(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []BackupObject
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, BackupObject{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local storage: %w", err)
+	}
+
+	return objects, nil
+}
+
+func (b *localBackend) Delete(ctx context.Context, key string) error {
+	file, err := b.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("failed to delete local file: %w", err)
+	}
+
+	return nil
+}
+
+func (b *localBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := b.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local file: %w", err)
+	}
+
+	return file, nil
+}
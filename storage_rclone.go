@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerStorageBackend("rclone", newRcloneBackend)
+}
+
+// rclone exits with these codes when the listed directory or file doesn't
+// exist.
+const (
+	rcloneExitDirNotFound  = 3
+	rcloneExitFileNotFound = 4
+)
+
+// rcloneBackend delegates to the rclone binary, making any of its remotes
+// usable as a destination. The remote itself is configured the usual rclone
+// way, through rclone.conf (RCLONE_CONFIG) or RCLONE_CONFIG_<NAME>_*
+// environment variables, which are passed through to rclone.
+type rcloneBackend struct {
+	binary    string
+	remote    string
+	extraArgs []string
+}
+
+func newRcloneBackend(cfg *Config) (StorageBackend, error) {
+	if err := checkRequired(map[string]string{"RCLONE_REMOTE": cfg.RcloneRemote}); err != nil {
+		return nil, err
+	}
+
+	binary, err := exec.LookPath(cfg.RcloneBinary)
+	if err != nil {
+		return nil, fmt.Errorf("rclone binary not found: %w", err)
+	}
+
+	return &rcloneBackend{
+		binary:    binary,
+		remote:    strings.TrimSuffix(cfg.RcloneRemote, "/"),
+		extraArgs: strings.Fields(cfg.RcloneExtraArgs),
+	}, nil
+}
+
+func (b *rcloneBackend) remotePath(key string) string {
+	if key == "" {
+		return b.remote
+	}
+	if strings.HasSuffix(b.remote, ":") {
+		return b.remote + key
+	}
+	return b.remote + "/" + key
+}
+
+func (b *rcloneBackend) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, b.binary, append(args, b.extraArgs...)...)
+}
+
+// run executes rclone and returns its output, including rclone's own error
+// message in the returned error.
+func (b *rcloneBackend) run(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := b.command(ctx, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("rclone %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (b *rcloneBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	_, err := b.run(ctx, body, "rcat", "--size", strconv.FormatInt(size, 10), b.remotePath(key))
+	if err != nil {
+		return fmt.Errorf("failed to upload with rclone: %w", err)
+	}
+
+	return nil
+}
+
+func (b *rcloneBackend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	dir := prefixDir(prefix)
+
+	out, err := b.run(ctx, nil, "lsjson", "--recursive", "--files-only", b.remotePath(dir))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == rcloneExitDirNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list with rclone: %w", err)
+	}
+
+	var entries []struct {
+		Path    string
+		Size    int64
+		ModTime time.Time
+	}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse rclone listing: %w", err)
+	}
+
+	var objects []BackupObject
+	for _, entry := range entries {
+		key := path.Join(dir, entry.Path)
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		objects = append(objects, BackupObject{
+			Key:          key,
+			Size:         entry.Size,
+			LastModified: entry.ModTime,
+		})
+	}
+
+	return objects, nil
+}
+
+func (b *rcloneBackend) Delete(ctx context.Context, key string) error {
+	if _, err := b.run(ctx, nil, "deletefile", b.remotePath(key)); err != nil {
+		return fmt.Errorf("failed to delete with rclone: %w", err)
+	}
+
+	return nil
+}
+
+func (b *rcloneBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	// rclone cat only fails once it is running, so a missing object is
+	// checked for first, for callers to fall back on a manifest.
+	out, err := b.run(ctx, nil, "lsjson", "--files-only", b.remotePath(key))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && (exitErr.ExitCode() == rcloneExitDirNotFound || exitErr.ExitCode() == rcloneExitFileNotFound) {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download with rclone: %w", err)
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse rclone listing: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := b.command(ctx, "cat", b.remotePath(key))
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to download with rclone: %w", err)
+	}
+
+	return &rcloneReader{ReadCloser: stdout, cmd: cmd, stderr: &stderr}, nil
+}
+
+// rcloneReader streams the output of rclone cat and reports rclone's exit
+// status at the end of the stream, so a failed download isn't mistaken for a
+// short object.
+type rcloneReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	done   bool
+}
+
+func (r *rcloneReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		if werr := r.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("failed to download with rclone: %w: %s", werr, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+
+	return n, err
+}
+
+// Close stops rclone if the caller stopped reading early, rather than
+// downloading the rest of the object for nothing.
+func (r *rcloneReader) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	r.cmd.Process.Kill()
+	r.cmd.Wait()
+
+	return nil
+}
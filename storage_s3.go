@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+func init() {
+	registerStorageBackend("r2", newR2Backend)
+	registerStorageBackend("s3", newS3Backend)
+}
+
+// s3Options holds the connection settings shared by every S3-compatible
+// provider (AWS S3, Cloudflare R2, MinIO, Wasabi, Backblaze S3, ...).
+type s3Options struct {
+	Name            string
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	ForcePathStyle  bool
+	StorageClass    string
+	ObjectTagging   bool
+	ObjectTags      map[string]string
+	ObjectLockMode  string
+	ObjectLockDays  int
+	LegalHold       bool
+	SSECustomerKey  string
+}
+
+type s3Backend struct {
+	client       *s3.Client
+	name         string
+	bucket       string
+	storageClass types.StorageClass
+	// tagKeys are the metadata keys attached as object tags, none without
+	// S3_OBJECT_TAGGING.
+	tagKeys []string
+
+	// Object Lock settings, applied to every upload. The bucket must have
+	// Object Lock enabled.
+	lockMode  types.ObjectLockMode
+	lockDays  int
+	legalHold bool
+
+	// Customer-provided key for SSE-C, in base64 with its MD5 digest as the
+	// requests carry them. Every request for an object needs the key it was
+	// uploaded with.
+	sseKey    *string
+	sseKeyMD5 *string
+}
+
+func newR2Backend(cfg *Config) (StorageBackend, error) {
+	err := checkRequired(map[string]string{
+		"R2_ACCESS_KEY_ID":     cfg.R2AccessKeyID,
+		"R2_SECRET_ACCESS_KEY": cfg.R2SecretAccessKey,
+		"R2_ACCOUNT_ID":        cfg.R2AccountID,
+		"R2_BUCKET":            cfg.R2Bucket,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newS3CompatibleBackend(s3Options{
+		Name:            "R2",
+		Endpoint:        fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cfg.R2AccountID),
+		Region:          "auto",
+		Bucket:          cfg.R2Bucket,
+		AccessKeyID:     cfg.R2AccessKeyID,
+		SecretAccessKey: cfg.R2SecretAccessKey,
+		StorageClass:    cfg.StorageClass,
+		ObjectTagging:   cfg.S3ObjectTagging,
+		ObjectTags:      cfg.ObjectTags,
+		ObjectLockMode:  cfg.ObjectLockMode,
+		ObjectLockDays:  cfg.ObjectLockDays,
+		LegalHold:       cfg.ObjectLegalHold,
+		SSECustomerKey:  cfg.SSECustomerKey,
+	})
+}
+
+func newS3Backend(cfg *Config) (StorageBackend, error) {
+	if err := checkRequired(map[string]string{"S3_BUCKET": cfg.S3Bucket}); err != nil {
+		return nil, err
+	}
+
+	// Static keys are optional, without them the default AWS credential
+	// chain is used.
+	if (cfg.S3AccessKeyID == "") != (cfg.S3SecretAccessKey == "") {
+		return nil, fmt.Errorf("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set together")
+	}
+
+	return newS3CompatibleBackend(s3Options{
+		Name:            "S3",
+		Endpoint:        cfg.S3Endpoint,
+		Region:          cfg.S3Region,
+		Bucket:          cfg.S3Bucket,
+		AccessKeyID:     cfg.S3AccessKeyID,
+		SecretAccessKey: cfg.S3SecretAccessKey,
+		ForcePathStyle:  cfg.S3ForcePathStyle,
+		StorageClass:    cfg.StorageClass,
+		ObjectTagging:   cfg.S3ObjectTagging,
+		ObjectTags:      cfg.ObjectTags,
+		ObjectLockMode:  cfg.ObjectLockMode,
+		ObjectLockDays:  cfg.ObjectLockDays,
+		LegalHold:       cfg.ObjectLegalHold,
+		SSECustomerKey:  cfg.SSECustomerKey,
+	})
+}
+
+// newReplicaBackend creates a backend for REPLICA_BUCKET that uses the same
+// provider and credentials as the primary backend, optionally in another
+// region.
+func newReplicaBackend(primary string, cfg *Config) (StorageBackend, error) {
+	replicaCfg := *cfg
+	switch primary {
+	case "r2":
+		replicaCfg.R2Bucket = cfg.ReplicaBucket
+		return newR2Backend(&replicaCfg)
+	case "s3":
+		replicaCfg.S3Bucket = cfg.ReplicaBucket
+		if cfg.ReplicaRegion != "" {
+			replicaCfg.S3Region = cfg.ReplicaRegion
+		}
+		return newS3Backend(&replicaCfg)
+	default:
+		return nil, fmt.Errorf("REPLICA_BUCKET is only supported with the r2 and s3 backends, not %s", primary)
+	}
+}
+
+func newS3CompatibleBackend(opts s3Options) (StorageBackend, error) {
+	client, err := createS3Client(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &s3Backend{
+		client:       client,
+		name:         opts.Name,
+		bucket:       opts.Bucket,
+		storageClass: types.StorageClass(opts.StorageClass),
+		lockMode:     types.ObjectLockMode(opts.ObjectLockMode),
+		lockDays:     opts.ObjectLockDays,
+		legalHold:    opts.LegalHold,
+	}
+
+	if opts.ObjectTagging {
+		// S3 allows 10 tags per object, so only the metadata useful in
+		// lifecycle rules is attached, along with OBJECT_TAGS.
+		backend.tagKeys = []string{"db", "backup-type", "tier"}
+		var extra []string
+		for k := range opts.ObjectTags {
+			if !slices.Contains(backend.tagKeys, k) {
+				extra = append(extra, k)
+			}
+		}
+		sort.Strings(extra)
+		backend.tagKeys = append(backend.tagKeys, extra...)
+		if len(backend.tagKeys) > maxS3Tags {
+			return nil, fmt.Errorf("too many OBJECT_TAGS for S3_OBJECT_TAGGING: S3 allows %d tags per object, including db, backup-type and tier", maxS3Tags)
+		}
+	}
+
+	if opts.SSECustomerKey != "" {
+		key, err := parseKey("SSE_C_KEY", opts.SSECustomerKey)
+		if err != nil {
+			return nil, err
+		}
+		digest := md5.Sum(key)
+		backend.sseKey = aws.String(base64.StdEncoding.EncodeToString(key))
+		backend.sseKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(digest[:]))
+	}
+
+	return backend, nil
+}
+
+// sseAlgorithm returns the algorithm header for SSE-C, or nil without it.
+func (b *s3Backend) sseAlgorithm() *string {
+	if b.sseKey == nil {
+		return nil
+	}
+
+	return aws.String("AES256")
+}
+
+// createS3Client uses static credentials when they are configured. Otherwise
+// credentials come from the default AWS chain: AWS_* environment variables,
+// shared config files, web identity tokens (EKS IRSA), ECS task roles and the
+// EC2 instance metadata service.
+func createS3Client(opts s3Options) (*s3.Client, error) {
+	var loadOpts []func(*config.LoadOptions) error
+	if opts.AccessKeyID != "" {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			opts.AccessKeyID,
+			opts.SecretAccessKey,
+			"",
+		)))
+	}
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.Region))
+	}
+
+	// Without an explicit endpoint the SDK resolves the regular AWS endpoint
+	// for the configured region.
+	if opts.Endpoint != "" {
+		resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{
+				URL:               opts.Endpoint,
+				HostnameImmutable: opts.ForcePathStyle,
+			}, nil
+		})
+		loadOpts = append(loadOpts, config.WithEndpointResolverWithOptions(resolver))
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(context.TODO(), loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config: %w", err)
+	}
+
+	if awsCfg.Region == "" {
+		awsCfg.Region = "us-east-1"
+	}
+
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = opts.ForcePathStyle
+	}), nil
+}
+
+func (b *s3Backend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		StorageClass:  b.storageClass,
+		Metadata:      metadata,
+
+		SSECustomerAlgorithm: b.sseAlgorithm(),
+		SSECustomerKey:       b.sseKey,
+		SSECustomerKeyMD5:    b.sseKeyMD5,
+	}
+
+	// Object tags can be used in lifecycle rules, unlike user metadata, but
+	// not every S3-compatible service supports them (R2 doesn't).
+	if len(b.tagKeys) > 0 {
+		tags := url.Values{}
+		for _, k := range b.tagKeys {
+			if v := metadata[k]; v != "" {
+				tags.Set(k, s3TagValue(v))
+			}
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	if b.lockMode != "" {
+		input.ObjectLockMode = b.lockMode
+		input.ObjectLockRetainUntilDate = aws.Time(b.retainUntil())
+		// Uploads with Object Lock headers must carry an integrity checksum.
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+	if b.legalHold {
+		input.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+
+	_, err := b.client.PutObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to upload to %s: %w", b.name, err)
+	}
+
+	return nil
+}
+
+// CopyFrom copies key from another bucket server-side. Objects larger than
+// 5 GB can't be copied in a single request, callers fall back to uploading.
+func (b *s3Backend) CopyFrom(ctx context.Context, src StorageBackend, key string) error {
+	source, ok := src.(*s3Backend)
+	if !ok {
+		return fmt.Errorf("server-side copy from %T is not supported", src)
+	}
+
+	segments := strings.Split(source.bucket+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:       aws.String(b.bucket),
+		Key:          aws.String(key),
+		CopySource:   aws.String(strings.Join(segments, "/")),
+		StorageClass: b.storageClass,
+
+		SSECustomerAlgorithm: b.sseAlgorithm(),
+		SSECustomerKey:       b.sseKey,
+		SSECustomerKeyMD5:    b.sseKeyMD5,
+
+		CopySourceSSECustomerAlgorithm: source.sseAlgorithm(),
+		CopySourceSSECustomerKey:       source.sseKey,
+		CopySourceSSECustomerKeyMD5:    source.sseKeyMD5,
+	}
+	if b.lockMode != "" {
+		input.ObjectLockMode = b.lockMode
+		input.ObjectLockRetainUntilDate = aws.Time(b.retainUntil())
+	}
+	if b.legalHold {
+		input.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	}
+
+	_, err := b.client.CopyObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s object: %w", b.name, err)
+	}
+
+	return nil
+}
+
+func (b *s3Backend) retainUntil() time.Time {
+	return time.Now().AddDate(0, 0, b.lockDays)
+}
+
+func (b *s3Backend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	var objects []BackupObject
+
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s objects: %w", b.name, err)
+		}
+
+		for _, obj := range page.Contents {
+			objects = append(objects, BackupObject{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+func (b *s3Backend) Delete(ctx context.Context, key string) error {
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s object: %w", b.name, err)
+	}
+
+	return nil
+}
+
+// SetLifecycle replaces the rule of this service for prefix in the lifecycle
+// configuration of the bucket, leaving the other rules in place.
+func (b *s3Backend) SetLifecycle(ctx context.Context, prefix string, days int) error {
+	id := "backup-service:" + prefix
+	rules := []types.LifecycleRule{{
+		ID:         aws.String(id),
+		Status:     types.ExpirationStatusEnabled,
+		Filter:     &types.LifecycleRuleFilterMemberPrefix{Value: prefix},
+		Expiration: &types.LifecycleExpiration{Days: aws.Int32(int32(days))},
+	}}
+
+	out, err := b.client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(b.bucket),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case err == nil:
+		for _, rule := range out.Rules {
+			if aws.ToString(rule.ID) != id {
+				rules = append(rules, rule)
+			}
+		}
+	case !errors.As(err, &apiErr) || apiErr.ErrorCode() != "NoSuchLifecycleConfiguration":
+		return fmt.Errorf("failed to read %s bucket lifecycle: %w", b.name, err)
+	}
+
+	_, err = b.client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(b.bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure %s bucket lifecycle: %w", b.name, err)
+	}
+
+	return nil
+}
+
+func (b *s3Backend) Metadata(ctx context.Context, key string) (map[string]string, error) {
+	out, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+
+		SSECustomerAlgorithm: b.sseAlgorithm(),
+		SSECustomerKey:       b.sseKey,
+		SSECustomerKeyMD5:    b.sseKeyMD5,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s object metadata: %w", b.name, err)
+	}
+
+	return out.Metadata, nil
+}
+
+func (b *s3Backend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+
+		SSECustomerAlgorithm: b.sseAlgorithm(),
+		SSECustomerKey:       b.sseKey,
+		SSECustomerKeyMD5:    b.sseKeyMD5,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from %s: %w", b.name, err)
+	}
+
+	return out.Body, nil
+}
+
+// maxS3Tags is the most tags S3 allows on an object.
+const maxS3Tags = 10
+
+// s3TagInvalidRe matches the characters S3 doesn't allow in tag values.
+var s3TagInvalidRe = regexp.MustCompile(`[^\p{L}\p{N} +\-=._:/@]`)
+
+// s3TagValue returns v with the characters S3 doesn't allow in tags, like
+// the commas of a list of databases, replaced, and cut to 256 characters.
+func s3TagValue(v string) string {
+	v = s3TagInvalidRe.ReplaceAllString(v, "_")
+	if runes := []rune(v); len(runes) > 256 {
+		v = string(runes[:256])
+	}
+
+	return v
+}
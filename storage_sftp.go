@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func init() {
+	registerStorageBackend("sftp", newSFTPBackend)
+}
+
+// sftpBackend stores backups as files below a directory on a remote server.
+// A new SSH connection is opened for every operation so that long idle
+// periods between scheduled runs don't leave a dead connection behind.
+type sftpBackend struct {
+	addr      string
+	dir       string
+	sshConfig *ssh.ClientConfig
+}
+
+func newSFTPBackend(cfg *Config) (StorageBackend, error) {
+	err := checkRequired(map[string]string{
+		"SFTP_HOST": cfg.SFTPHost,
+		"SFTP_USER": cfg.SFTPUser,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.SFTPPrivateKeyFile != "" {
+		signer, err := loadSSHSigner(cfg.SFTPPrivateKeyFile, cfg.SFTPPrivateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.SFTPPassword != "" {
+		auth = append(auth, ssh.Password(cfg.SFTPPassword))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("either SFTP_PRIVATE_KEY_FILE or SFTP_PASSWORD must be set")
+	}
+
+	hostKeyCallback, err := sftpHostKeyCallback(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpBackend{
+		addr: net.JoinHostPort(cfg.SFTPHost, cfg.SFTPPort),
+		dir:  cfg.SFTPDir,
+		sshConfig: &ssh.ClientConfig{
+			User:            cfg.SFTPUser,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+	}, nil
+}
+
+func loadSSHSigner(keyFile, passphrase string) (ssh.Signer, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH private key: %w", err)
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH private key: %w", err)
+	}
+
+	return signer, nil
+}
+
+// sftpHostKeyCallback verifies the server against a known_hosts file or a
+// pinned SHA256 fingerprint. Connecting to unverified hosts is not supported.
+func sftpHostKeyCallback(cfg *Config) (ssh.HostKeyCallback, error) {
+	if cfg.SFTPKnownHostsFile != "" {
+		callback, err := knownhosts.New(cfg.SFTPKnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SFTP known hosts: %w", err)
+		}
+		return callback, nil
+	}
+
+	if cfg.SFTPHostKeyFingerprint != "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); fingerprint != cfg.SFTPHostKeyFingerprint {
+				return fmt.Errorf("host key fingerprint mismatch for %s: got %s", hostname, fingerprint)
+			}
+			return nil
+		}, nil
+	}
+
+	return nil, fmt.Errorf("either SFTP_KNOWN_HOSTS_FILE or SFTP_HOST_KEY_FINGERPRINT must be set")
+}
+
+func (b *sftpBackend) connect() (*ssh.Client, *sftp.Client, error) {
+	conn, err := ssh.Dial("tcp", b.addr, b.sshConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to SFTP server: %w", err)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+
+	return conn, client, nil
+}
+
+func (b *sftpBackend) remotePath(key string) string {
+	return path.Join(b.dir, key)
+}
+
+// Put uploads body to a temporary file next to key first, which List skips,
+// and renames it into place once it is complete, so an interrupted upload
+// never leaves a truncated backup under key.
+func (b *sftpBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	conn, client, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	// Closing the connection aborts a running upload.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	remote := b.remotePath(key)
+	if err := client.MkdirAll(path.Dir(remote)); err != nil {
+		return fmt.Errorf("failed to create SFTP directory: %w", err)
+	}
+
+	tmp := path.Join(path.Dir(remote), ".upload-"+path.Base(remote))
+	file, err := client.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create SFTP file: %w", err)
+	}
+	defer client.Remove(tmp)
+
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("failed to upload to SFTP: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to upload to SFTP: %w", err)
+	}
+
+	// Plain SFTP renames refuse to replace an existing file, the OpenSSH
+	// extension does so atomically.
+	if err := client.PosixRename(tmp, remote); err != nil {
+		client.Remove(remote)
+		if err := client.Rename(tmp, remote); err != nil {
+			return fmt.Errorf("failed to move SFTP file into place: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (b *sftpBackend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	conn, client, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	root := b.remotePath(prefixDir(prefix))
+	if _, err := client.Stat(root); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	var objects []BackupObject
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list SFTP files: %w", err)
+		}
+
+		info := walker.Stat()
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			continue
+		}
+
+		key := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), b.dir), "/")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		objects = append(objects, BackupObject{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	}
+
+	return objects, nil
+}
+
+func (b *sftpBackend) Delete(ctx context.Context, key string) error {
+	conn, client, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	if err := client.Remove(b.remotePath(key)); err != nil {
+		return fmt.Errorf("failed to delete SFTP file: %w", err)
+	}
+
+	return nil
+}
+
+func (b *sftpBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	conn, client, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := client.Open(b.remotePath(key))
+	if err != nil {
+		client.Close()
+		conn.Close()
+		return nil, fmt.Errorf("failed to download from SFTP: %w", err)
+	}
+
+	return &sftpReadCloser{File: file, client: client, conn: conn}, nil
+}
+
+// sftpReadCloser closes the SFTP session and SSH connection together with
+// the downloaded file.
+type sftpReadCloser struct {
+	*sftp.File
+	client *sftp.Client
+	conn   *ssh.Client
+}
+
+func (r *sftpReadCloser) Close() error {
+	err := r.File.Close()
+	r.client.Close()
+	r.conn.Close()
+	return err
+}
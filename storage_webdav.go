@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/studio-b12/gowebdav"
+)
+
+func init() {
+	registerStorageBackend("webdav", newWebDAVBackend)
+}
+
+// webdavBackend stores backups on a WebDAV server such as Nextcloud or
+// ownCloud. Listing uses PROPFIND, walking one collection at a time.
+type webdavBackend struct {
+	client *gowebdav.Client
+	dir    string
+}
+
+func newWebDAVBackend(cfg *Config) (StorageBackend, error) {
+	if err := checkRequired(map[string]string{"WEBDAV_URL": cfg.WebDAVURL}); err != nil {
+		return nil, err
+	}
+
+	return &webdavBackend{
+		client: gowebdav.NewClient(cfg.WebDAVURL, cfg.WebDAVUser, cfg.WebDAVPassword),
+		dir:    cfg.WebDAVDir,
+	}, nil
+}
+
+func (b *webdavBackend) remotePath(key string) string {
+	return path.Join("/", b.dir, key)
+}
+
+func (b *webdavBackend) Put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) error {
+	if err := b.client.WriteStream(b.remotePath(key), body, 0644); err != nil {
+		return fmt.Errorf("failed to upload to WebDAV: %w", err)
+	}
+
+	return nil
+}
+
+func (b *webdavBackend) List(ctx context.Context, prefix string) ([]BackupObject, error) {
+	var objects []BackupObject
+	if err := b.walk(prefixDir(prefix), prefix, &objects); err != nil {
+		return nil, fmt.Errorf("failed to list WebDAV files: %w", err)
+	}
+
+	return objects, nil
+}
+
+func (b *webdavBackend) walk(dir, prefix string, objects *[]BackupObject) error {
+	entries, err := b.client.ReadDir(b.remotePath(dir))
+	if gowebdav.IsErrNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		key := strings.TrimPrefix(path.Join(dir, entry.Name()), "/")
+		if entry.IsDir() {
+			if err := b.walk(key, prefix, objects); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		*objects = append(*objects, BackupObject{
+			Key:          key,
+			Size:         entry.Size(),
+			LastModified: entry.ModTime(),
+		})
+	}
+
+	return nil
+}
+
+func (b *webdavBackend) Delete(ctx context.Context, key string) error {
+	if err := b.client.Remove(b.remotePath(key)); err != nil {
+		return fmt.Errorf("failed to delete WebDAV file: %w", err)
+	}
+
+	return nil
+}
+
+func (b *webdavBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := b.client.ReadStream(b.remotePath(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from WebDAV: %w", err)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// backupOnSignal runs every backup in backups whenever the service receives
+// SIGUSR1, so operators can take a backup right before risky maintenance:
+//
+//	docker kill --signal=USR1 backup
+//
+// Signals received while the backups run are coalesced into one more run.
+func backupOnSignal(backups []func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	for range signals {
+		slog.Info("Received SIGUSR1, starting backup", "job", "backup")
+		for _, backup := range backups {
+			backup()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// runVerify implements the verify command, which checks that backups on the
+// primary destination are intact without restoring them, and prints PASS or
+// FAIL for each. Without keys, every backup of every source is verified:
+//
+//	backup-app verify --decrypt backups/app_backup_20240101_020000.sql.gz.enc
+//
+// The command exits with 1 if a backup failed verification.
+func runVerify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	decrypt := flags.Bool("decrypt", false, "also decrypt encrypted backups, which needs their key")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	type artifact struct {
+		cfg  *Config
+		dest Destination
+		key  string
+	}
+	var artifacts []artifact
+	if flags.NArg() > 0 {
+		cfg, err := loadRestoreConfig()
+		if err != nil {
+			fatalf("Failed to load configuration: %v", err)
+		}
+		destinations, err := newDestinations(cfg)
+		if err != nil {
+			fatalf("Failed to create storage backend: %v", err)
+		}
+		for _, key := range flags.Args() {
+			artifacts = append(artifacts, artifact{cfg: cfg, dest: destinations[0], key: key})
+		}
+	} else {
+		configs, err := loadRestoreConfigs()
+		if err != nil {
+			fatalf("Failed to load configuration: %v", err)
+		}
+		for _, cfg := range configs {
+			destinations, err := newDestinations(cfg)
+			if err != nil {
+				fatalf("Failed to create storage backend: %v", err)
+			}
+			sources, err := newSources(cfg)
+			if err != nil {
+				fatalf("Failed to create backup source: %v", err)
+			}
+			for _, source := range sources {
+				backups, err := listBackups(ctx, destinations[0], source.Name())
+				if err != nil {
+					fatalf("Failed to list backups of %s: %v", source.Name(), err)
+				}
+				for _, backup := range backups {
+					artifacts = append(artifacts, artifact{cfg: cfg, dest: destinations[0], key: backup.Key})
+				}
+			}
+		}
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tKEY\tCHECKS")
+	for _, a := range artifacts {
+		checks, err := verifyBackup(ctx, a.cfg, a.dest, a.key, *decrypt)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL\t%s\t%v\n", a.key, err)
+			continue
+		}
+		fmt.Fprintf(w, "PASS\t%s\t%s\n", a.key, strings.Join(checks, ", "))
+	}
+	w.Flush()
+
+	if failed > 0 {
+		slog.Error(fmt.Sprintf("%d of %d backups failed verification", failed, len(artifacts)))
+		os.Exit(1)
+	}
+}
+
+// verifyBackup downloads the backup at key on dest and checks it against its
+// sha256 metadata, or the checksums in its manifest if it was split, and
+// that it decompresses. Encrypted backups are only decrypted, and so only
+// decompressed, with decrypt. It returns the checks that were made.
+func verifyBackup(ctx context.Context, cfg *Config, dest Destination, key string, decrypt bool) ([]string, error) {
+	decrypter, comp, _, err := backupEncoding(cfg, key)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := openBackup(ctx, dest.Storage, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	sum := sha256.New()
+	stored := io.TeeReader(body, sum)
+	checks := []string{"downloaded"}
+	if decrypter == nil || decrypt {
+		r := stored
+		if decrypter != nil {
+			if r, err = decrypter(cfg, r); err != nil {
+				return nil, fmt.Errorf("failed to decrypt backup: %w", err)
+			}
+			checks = append(checks, "decrypted")
+		}
+		if r, err = comp.NewReader(r); err != nil {
+			return nil, fmt.Errorf("failed to decompress backup: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, fmt.Errorf("backup is corrupt: %w", err)
+		}
+		if comp.Extension() != "" {
+			checks = append(checks, "decompressed")
+		}
+	}
+	if _, err := io.Copy(io.Discard, stored); err != nil {
+		return nil, fmt.Errorf("failed to download backup: %w", err)
+	}
+
+	// Split backups were checked against their manifest while reading them.
+	if expected := metadataSHA256(ctx, dest, key); expected != "" {
+		if expected != hex.EncodeToString(sum.Sum(nil)) {
+			return nil, fmt.Errorf("checksum mismatch: expected %s, got %x", expected, sum.Sum(nil))
+		}
+		checks = append(checks, "sha256")
+	} else if _, err := readManifest(ctx, dest.Storage, key); err == nil {
+		checks = append(checks, "sha256")
+	}
+
+	return checks, nil
+}
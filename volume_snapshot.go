@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	// Labels of the VolumeSnapshots created by the service, to find them for
+	// pruning.
+	snapshotManagedByLabel = "app.kubernetes.io/managed-by"
+	snapshotPVCLabel       = "backup-service/pvc"
+
+	// How often a new snapshot is checked for being ready.
+	snapshotPollInterval = 2 * time.Second
+)
+
+// volumeSnapshot is the part of a snapshot.storage.k8s.io/v1 VolumeSnapshot
+// the service uses.
+type volumeSnapshot struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name              string            `json:"name"`
+		Namespace         string            `json:"namespace,omitempty"`
+		Labels            map[string]string `json:"labels,omitempty"`
+		CreationTimestamp string            `json:"creationTimestamp,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+		Source                  struct {
+			PersistentVolumeClaimName string `json:"persistentVolumeClaimName"`
+		} `json:"source"`
+	} `json:"spec"`
+	Status *struct {
+		ReadyToUse *bool `json:"readyToUse"`
+		Error      *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"status,omitempty"`
+}
+
+// snapshotVolumes takes a CSI VolumeSnapshot of every PVC in K8S_SNAPSHOT_PVC
+// before the backups of a run are copied, giving a crash-consistent restore
+// point inside the cluster even for workloads too busy to copy consistently.
+// Failures are logged, they don't keep the backups from running.
+func snapshotVolumes(ctx context.Context, cfg *Config) {
+	pvcs := splitList(cfg.K8sSnapshotPVC)
+	if len(pvcs) == 0 {
+		return
+	}
+
+	client, err := newKubeClient(cfg.K8sNamespace)
+	if err != nil {
+		slog.Info("Volume snapshots skipped", "job", "snapshot", "error", err)
+		return
+	}
+
+	for _, pvc := range pvcs {
+		if err := client.snapshotVolume(ctx, cfg, pvc); err != nil {
+			slog.Error("Volume snapshot failed", "pvc", pvc, "error", err)
+			continue
+		}
+		client.pruneSnapshots(ctx, pvc, cfg.K8sSnapshotKeep)
+	}
+}
+
+// snapshotVolume creates a VolumeSnapshot of pvc and waits until it is ready
+// to use.
+func (c *kubeClient) snapshotVolume(ctx context.Context, cfg *Config, pvc string) error {
+	var snapshot volumeSnapshot
+	snapshot.APIVersion = "snapshot.storage.k8s.io/v1"
+	snapshot.Kind = "VolumeSnapshot"
+	snapshot.Metadata.Name = fmt.Sprintf("%s-backup-%s", pvc, time.Now().UTC().Format("20060102-150405"))
+	snapshot.Metadata.Labels = map[string]string{
+		snapshotManagedByLabel: "backup-service",
+		snapshotPVCLabel:       pvc,
+	}
+	snapshot.Spec.VolumeSnapshotClassName = cfg.K8sSnapshotClass
+	snapshot.Spec.Source.PersistentVolumeClaimName = pvc
+
+	if err := c.do(ctx, http.MethodPost, c.snapshotsPath(), nil, snapshot, nil); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.K8sSnapshotTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(snapshotPollInterval)
+	defer ticker.Stop()
+
+	name := snapshot.Metadata.Name
+	for {
+		var current volumeSnapshot
+		if err := c.do(ctx, http.MethodGet, c.snapshotsPath()+"/"+name, nil, nil, &current); err != nil {
+			return err
+		}
+		if status := current.Status; status != nil {
+			if status.Error != nil && status.Error.Message != "" {
+				return fmt.Errorf("snapshot %s failed: %s", name, status.Error.Message)
+			}
+			if status.ReadyToUse != nil && *status.ReadyToUse {
+				slog.Info("Created volume snapshot", "job", "snapshot", "snapshot", name, "pvc", pvc)
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("snapshot %s not ready after %v", name, cfg.K8sSnapshotTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneSnapshots deletes the snapshots of pvc taken by the service, except
+// for the newest keep ones.
+func (c *kubeClient) pruneSnapshots(ctx context.Context, pvc string, keep int) {
+	selector := snapshotManagedByLabel + "=backup-service," + snapshotPVCLabel + "=" + pvc
+
+	var list struct {
+		Items []volumeSnapshot `json:"items"`
+	}
+	if err := c.do(ctx, http.MethodGet, c.snapshotsPath(), url.Values{"labelSelector": {selector}}, nil, &list); err != nil {
+		slog.Warn("Volume snapshot cleanup failed", "pvc", pvc, "error", err)
+		return
+	}
+
+	snapshots := list.Items
+	// Timestamps are in RFC 3339, which sorts chronologically as strings.
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Metadata.CreationTimestamp > snapshots[j].Metadata.CreationTimestamp
+	})
+	if len(snapshots) <= keep {
+		return
+	}
+
+	for _, snapshot := range snapshots[keep:] {
+		name := snapshot.Metadata.Name
+		if err := c.do(ctx, http.MethodDelete, c.snapshotsPath()+"/"+name, nil, nil, nil); err != nil {
+			slog.Error("Failed to delete old volume snapshot", "snapshot", name, "error", err)
+		} else {
+			slog.Info("Deleted old volume snapshot", "job", "snapshot", "snapshot", name, "pvc", pvc)
+		}
+	}
+}
+
+func (c *kubeClient) snapshotsPath() string {
+	return "/apis/snapshot.storage.k8s.io/v1/namespaces/" + url.PathEscape(c.namespace) + "/volumesnapshots"
+}
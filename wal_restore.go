@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// restoreWAL restores the SQLite database name from the WAL shipped to dest,
+// the reverse of walShipper: the snapshot of generation, or of the latest
+// generation if it is empty, is downloaded, the frames of all segments of
+// the generation are written after a single WAL header next to it, and
+// SQLite applies them when the database is checkpointed. Like any restore,
+// the result must pass an integrity check before it is moved into place.
+func restoreWAL(ctx context.Context, cfg *Config, dest Destination, name, generation, target string, force bool) error {
+	mode, err := checkTarget(target, force)
+	if err != nil {
+		return err
+	}
+
+	prefix := listPrefix(dest.KeyPrefix, name) + name + "-wal/"
+	objects, err := dest.Storage.List(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL generations: %w", err)
+	}
+	snapshots := map[string]string{}
+	segments := map[string][]string{}
+	for _, obj := range objects {
+		gen, file, ok := strings.Cut(strings.TrimPrefix(obj.Key, prefix), "/")
+		switch {
+		case !ok:
+		case strings.HasPrefix(file, "snapshot.db.gz"):
+			snapshots[gen] = obj.Key
+		case strings.HasPrefix(file, "wal/"):
+			segments[gen] = append(segments[gen], obj.Key)
+		}
+	}
+
+	// Generations are named by their start time, which sorts as a string.
+	if generation == "" {
+		for gen := range snapshots {
+			if gen > generation {
+				generation = gen
+			}
+		}
+		if generation == "" {
+			return fmt.Errorf("no WAL generations of %s on %s", name, dest.Name)
+		}
+	}
+	snapshot, ok := snapshots[generation]
+	if !ok {
+		return fmt.Errorf("no snapshot of WAL generation %s of %s on %s", generation, name, dest.Name)
+	}
+	segs := segments[generation]
+	sort.Strings(segs)
+	for i, key := range segs {
+		seq, _, _ := strings.Cut(path.Base(key), ".")
+		if n, err := strconv.Atoi(seq); err != nil || n != i {
+			return fmt.Errorf("segment %d of WAL generation %s is missing", i, generation)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".restore-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name() + "-wal")
+	defer os.Remove(tmp.Name() + "-shm")
+	defer tmp.Close()
+	if err := tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	if err := downloadTo(ctx, cfg, dest, snapshot, tmp, 0); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	// Snapshots are standalone databases, SQLite only reads a -wal file
+	// next to a database in WAL mode.
+	db, err := openSQLite(tmp.Name(), false)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	_, err = db.ExecContext(ctx, "PRAGMA journal_mode=WAL")
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("failed to switch snapshot to WAL mode: %w", err)
+	}
+
+	frames, err := writeShippedWAL(ctx, cfg, dest, segs, tmp.Name()+"-wal")
+	if err != nil {
+		return err
+	}
+
+	// Frames that don't continue the checksums of the ones before are
+	// silently ignored by SQLite, so the number applied is checked.
+	db, err = openSQLite(tmp.Name(), false)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	var busy, logFrames, checkpointed int
+	err = db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(FULL)").Scan(&busy, &logFrames, &checkpointed)
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("failed to apply WAL: %w", err)
+	}
+	if int64(logFrames) != frames || checkpointed != logFrames {
+		return fmt.Errorf("only %d of %d WAL frames of generation %s could be applied", min(logFrames, checkpointed), frames, generation)
+	}
+
+	if err := makeStandalone(ctx, tmp.Name()); err != nil {
+		return err
+	}
+	if err := sqliteIntegrityCheck(ctx, tmp.Name(), "full"); err != nil {
+		return fmt.Errorf("restored database is corrupt: %w", err)
+	}
+
+	if err := replaceTarget(ctx, cfg, tmp.Name(), target); err != nil {
+		return err
+	}
+
+	slog.Info("Restored database from shipped WAL", "job", "restore", "source", name, "destination", dest.Name, "generation", generation, "segments", len(segs), "frames", frames, "path", target)
+	return nil
+}
+
+// writeShippedWAL joins the segments at keys into a WAL file at walPath,
+// with the header of the first segment only, and returns the number of
+// frames in it.
+func writeShippedWAL(ctx context.Context, cfg *Config, dest Destination, keys []string, walPath string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	wal, err := os.Create(walPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create WAL file: %w", err)
+	}
+	defer wal.Close()
+
+	for i, key := range keys {
+		skip := int64(walHeaderSize)
+		if i == 0 {
+			skip = 0
+		}
+		if err := downloadTo(ctx, cfg, dest, key, wal, skip); err != nil {
+			return 0, err
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to write WAL file: %w", err)
+	}
+
+	info, err := wal.Stat()
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, walHeaderSize)
+	if _, err := wal.ReadAt(header, 0); err != nil {
+		return 0, fmt.Errorf("failed to read WAL header: %w", err)
+	}
+	pageSize := int64(binary.BigEndian.Uint32(header[8:12]))
+
+	return (info.Size() - walHeaderSize) / (walFrameHeaderSize + pageSize), nil
+}
+
+// downloadTo restores the object at key on dest into w, leaving out its
+// first skip bytes.
+func downloadTo(ctx context.Context, cfg *Config, dest Destination, key string, w io.Writer, skip int64) error {
+	plain, err := openRestore(ctx, cfg, dest, key)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+
+	if _, err := io.CopyN(io.Discard, plain, skip); err != nil {
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	if _, err := io.Copy(w, plain); err != nil {
+		return fmt.Errorf("failed to download %s: %w", key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+)
+
+// walShipper continuously replicates an SQLite database in WAL mode to a
+// destination, Litestream-style, so that at most WAL_SHIPPING_INTERVAL worth
+// of transactions is lost instead of everything since the last daily backup.
+//
+// Replication happens in generations. A generation starts with a snapshot of
+// the database, followed by segments with the WAL frames committed since.
+// Replaying the frames of all segments in order onto the snapshot gives the
+// state of the database as of the last segment; frames that are already part
+// of the snapshot are harmless to replay, they are overwritten by later ones.
+//
+// Frames can only be shipped as long as SQLite doesn't restart the WAL, which
+// it does after a checkpoint copied all frames into the database. The shipper
+// therefore keeps a read transaction open, which holds off restarts, and
+// only releases it once the generation is older than
+// WAL_GENERATION_INTERVAL. Whenever a restart is detected, because the salt
+// in the WAL header changed, a new generation is started, as frames written
+// between the last poll and the restart could be missing otherwise.
+type walShipper struct {
+	name               string
+	dbPath             string
+	tempDir            string
+	dest               Destination
+	interval           time.Duration
+	generationInterval time.Duration
+	retentionDays      int
+	enc                Encryptor
+
+	db *sql.DB
+	tx *sql.Tx
+
+	generation        string
+	generationStarted time.Time
+	header            []byte
+	offset            int64
+	checksum          [2]uint32
+	seq               int
+}
+
+// startWALShipping starts a shipper for every SQLite database that is
+// backed up, replicating to the primary destination.
+func startWALShipping(ctx context.Context, cfg *Config, destinations []Destination) error {
+	list, err := newSources(cfg)
+	if err != nil {
+		return err
+	}
+	enc, err := newEncryptor(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range list {
+		s, ok := source.(*sqliteSource)
+		if !ok || s.cmd != nil {
+			continue
+		}
+		if !sqliteWALMode(s.dbPath) {
+			slog.Info("Not shipping WAL: database is not in WAL mode", "job", "wal", "source", s.Name(), "path", s.dbPath)
+			continue
+		}
+
+		shipper := &walShipper{
+			name:               s.name,
+			dbPath:             s.dbPath,
+			tempDir:            cfg.BackupDir,
+			dest:               destinations[0],
+			interval:           cfg.WALShippingInterval,
+			generationInterval: cfg.WALGenerationInterval,
+			retentionDays:      destinations[0].Retention.Days,
+			enc:                enc,
+		}
+		go shipper.run(ctx)
+	}
+
+	return nil
+}
+
+// prefix is where the generations of the database are stored.
+func (w *walShipper) prefix() string {
+	return listPrefix(w.dest.KeyPrefix, w.name) + w.name + "-wal/"
+}
+
+func (w *walShipper) run(ctx context.Context) {
+	slog.Info("Shipping WAL", "job", "wal", "source", w.name, "destination", w.dest.Name, "path", w.dbPath, "interval", w.interval)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.poll(ctx); err != nil {
+			slog.Error("WAL shipping failed", "source", w.name, "error", err)
+			// Start over with a new generation, there is no telling which
+			// frames made it.
+			w.reset()
+		}
+
+		select {
+		case <-ctx.Done():
+			w.reset()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reset releases the read transaction and forgets the current generation.
+func (w *walShipper) reset() {
+	w.release()
+	if w.db != nil {
+		w.db.Close()
+		w.db = nil
+	}
+	w.generation = ""
+}
+
+func (w *walShipper) release() {
+	if w.tx != nil {
+		w.tx.Rollback()
+		w.tx = nil
+	}
+}
+
+// hold starts a read transaction, which keeps SQLite from restarting the WAL
+// until it is released.
+func (w *walShipper) hold(ctx context.Context) error {
+	if w.tx != nil {
+		return nil
+	}
+
+	if w.db == nil {
+		db, err := openSQLite(w.dbPath, true)
+		if err != nil {
+			return err
+		}
+		db.SetMaxOpenConns(1)
+		w.db = db
+	}
+
+	tx, err := w.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	// SQLite only takes the read lock with the first read.
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&n); err != nil {
+		tx.Rollback()
+		return err
+	}
+	w.tx = tx
+
+	return nil
+}
+
+func (w *walShipper) poll(ctx context.Context) error {
+	if err := w.hold(ctx); err != nil {
+		return fmt.Errorf("failed to start read transaction: %w", err)
+	}
+
+	wal, err := os.Open(w.dbPath + "-wal")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer wal.Close()
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(wal, header); err != nil {
+		// An empty WAL, nothing was written since the last restart.
+		return nil
+	}
+
+	if w.generation == "" || !bytes.Equal(header[16:24], w.header[16:24]) {
+		if w.generation != "" {
+			slog.Info("WAL was restarted, starting a new generation", "job", "wal", "source", w.name, "destination", w.dest.Name)
+		}
+		if err := w.startGeneration(ctx, header); err != nil {
+			return err
+		}
+	}
+
+	if err := w.ship(ctx, wal); err != nil {
+		return err
+	}
+
+	// Let SQLite restart the WAL once in a while, which starts a new
+	// generation, so the WAL doesn't grow forever.
+	if time.Since(w.generationStarted) > w.generationInterval {
+		w.release()
+	}
+
+	return nil
+}
+
+// startGeneration uploads a snapshot of the database and ships frames from
+// the start of the current WAL on.
+func (w *walShipper) startGeneration(ctx context.Context, header []byte) error {
+	generation := time.Now().UTC().Format("20060102T150405Z")
+
+	snapshot := &sqliteSource{
+		name:           w.name,
+		dbPath:         w.dbPath,
+		tempDir:        w.tempDir,
+		mode:           "backup",
+		integrityCheck: "off",
+	}
+	snapshotFile := filepath.Join(w.tempDir, fmt.Sprintf("%s-wal-%s.db.gz%s", w.name, generation, w.enc.Extension()))
+	defer os.Remove(snapshotFile)
+
+	// Snapshots and segments are always gzip compressed, so generations stay
+	// readable when COMPRESSION changes.
+	if err := createBackup(ctx, snapshot, gzipCompressor{}, w.enc, snapshotFile); err != nil {
+		return err
+	}
+
+	w.generation = generation
+	key := w.prefix() + generation + "/snapshot.db.gz" + w.enc.Extension()
+	if err := uploadBackup(ctx, w.dest.Storage, key, snapshotFile, w.metadata()); err != nil {
+		w.generation = ""
+		return err
+	}
+
+	w.generationStarted = time.Now()
+	w.header = header
+	w.offset = walHeaderSize
+	w.checksum = [2]uint32{binary.BigEndian.Uint32(header[24:28]), binary.BigEndian.Uint32(header[28:32])}
+	w.seq = 0
+	slog.Info("Started WAL generation", "job", "wal", "source", w.name, "destination", w.dest.Name, "generation", generation)
+
+	w.prune(ctx)
+
+	return nil
+}
+
+// ship uploads the frames committed since the last poll as a segment. A
+// segment starts with the WAL header, so it can be read on its own.
+func (w *walShipper) ship(ctx context.Context, wal *os.File) error {
+	pageSize := int64(binary.BigEndian.Uint32(w.header[8:12]))
+	frame := make([]byte, walFrameHeaderSize+pageSize)
+
+	// Only frames up to the last commit frame are complete transactions.
+	// Frames with another salt or a bad checksum are left over from before
+	// the last restart or still being written.
+	segment := bytes.NewBuffer(append([]byte(nil), w.header...))
+	var pending bytes.Buffer
+	offset, checksum := w.offset, w.checksum
+	for {
+		if _, err := wal.ReadAt(frame, offset); err != nil {
+			break
+		}
+		if !bytes.Equal(frame[8:16], w.header[16:24]) {
+			break
+		}
+		checksum = walChecksum(w.header, checksum, frame[:8])
+		checksum = walChecksum(w.header, checksum, frame[walFrameHeaderSize:])
+		if checksum[0] != binary.BigEndian.Uint32(frame[16:20]) || checksum[1] != binary.BigEndian.Uint32(frame[20:24]) {
+			break
+		}
+
+		pending.Write(frame)
+		offset += int64(len(frame))
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			segment.Write(pending.Bytes())
+			pending.Reset()
+			w.offset, w.checksum = offset, checksum
+		}
+	}
+	if segment.Len() == walHeaderSize {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s%s/wal/%08d.wal.gz%s", w.prefix(), w.generation, w.seq, w.enc.Extension())
+	if err := w.upload(ctx, key, segment); err != nil {
+		return err
+	}
+	w.seq++
+
+	return nil
+}
+
+// walChecksum continues the cumulative WAL checksum s over data, using the
+// byte order given by the magic number in the WAL header.
+func walChecksum(header []byte, s [2]uint32, data []byte) [2]uint32 {
+	var order binary.ByteOrder = binary.LittleEndian
+	if binary.BigEndian.Uint32(header[0:4]) == 0x377f0683 {
+		order = binary.BigEndian
+	}
+
+	for i := 0; i+8 <= len(data); i += 8 {
+		s[0] += order.Uint32(data[i:]) + s[1]
+		s[1] += order.Uint32(data[i+4:]) + s[0]
+	}
+
+	return s
+}
+
+// upload compresses and encrypts r and uploads it to key. Segments are small
+// enough to be handled in memory.
+func (w *walShipper) upload(ctx context.Context, key string, r io.Reader) error {
+	buf, err := gzipEncrypt(r, w.enc)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+
+	return w.dest.Storage.Put(ctx, key, buf, int64(buf.Len()), w.metadata())
+}
+
+func (w *walShipper) metadata() map[string]string {
+	return map[string]string{
+		"db":          w.name,
+		"hostname":    hostname(),
+		"backup-type": "sqlite-wal",
+		"generation":  w.generation,
+	}
+}
+
+// prune deletes the objects of generations older than the retention period.
+// The current generation is always kept.
+func (w *walShipper) prune(ctx context.Context) {
+	objects, err := w.dest.Storage.List(ctx, w.prefix())
+	if err != nil {
+		slog.Warn("WAL cleanup failed", "source", w.name, "error", err)
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -w.retentionDays)
+	current := w.prefix() + w.generation + "/"
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Key, current) || !obj.LastModified.Before(cutoff) {
+			continue
+		}
+		if err := w.dest.Storage.Delete(ctx, obj.Key); err != nil {
+			slog.Error("Failed to delete old WAL object", "source", w.name, "key", obj.Key, "error", err)
+		}
+	}
+}
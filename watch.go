@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// startWatching starts watching every SQLite database that is backed up for
+// changes, backing up the source block once a database was changed and then
+// left alone for WATCH_DEBOUNCE, instead of only at the scheduled times.
+func startWatching(ctx context.Context, cfg *Config, destinations []Destination) error {
+	list, err := newSources(cfg)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, source := range list {
+		if s, ok := source.(*sqliteSource); ok && s.cmd == nil {
+			paths = append(paths, s.dbPath)
+		}
+	}
+	if len(paths) == 0 {
+		slog.Info("Not watching for changes: no SQLite database is backed up", "job", "backup")
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// The directories are watched rather than the files, so changes to the
+	// -wal file are seen too, and the database is still watched after it
+	// was replaced by renaming another file over it.
+	watched := map[string]bool{}
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+		watched[dir] = true
+	}
+
+	go watchChanges(ctx, cfg, destinations, watcher, paths)
+	return nil
+}
+
+func watchChanges(ctx context.Context, cfg *Config, destinations []Destination, watcher *fsnotify.Watcher, paths []string) {
+	defer watcher.Close()
+
+	files := map[string]bool{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		files[path] = true
+		files[path+"-wal"] = true
+		files[path+"-journal"] = true
+		slog.Info("Watching for changes", "job", "backup", "path", path, "debounce", cfg.WatchDebounce)
+	}
+
+	timer := time.NewTimer(cfg.WatchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !files[filepath.Clean(event.Name)] || event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			// Every change postpones the backup, so a burst of writes
+			// results in a single backup.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(cfg.WatchDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Watching for changes failed", "error", err)
+		case <-timer.C:
+			slog.Info("Starting backup after changes", "job", "backup")
+			runAndRecord(cfg, destinations, "")
+		}
+	}
+}